@@ -16,7 +16,7 @@ func New(limit int, d disk.Disk, log logger.Log) *cache {
 	if limit < MinCacheSize {
 		limit = MinCacheSize
 	}
-	return &cache{
+	c := &cache{
 		log:   log,
 		mp:    new(sync.Map),
 		cq:    new(list.List),
@@ -27,18 +27,17 @@ func New(limit int, d disk.Disk, log logger.Log) *cache {
 		n:     limit / FreeMultiples,
 		pch:   make(chan *page, 1024),
 	}
+	for i := constant.RootPage; i < constant.Preallocate; i++ {
+		b, err := c.sched.Read(i)
+		if err != nil {
+			log.Fatalf("failed to load root page: %v\n", err)
+		}
+		c.ps[i] = &page{b: b, cp: c}
+	}
+	return c
 }
 
 func (c *cache) Run() {
-	{
-		for i := constant.RootPage; i < constant.Preallocate; i++ {
-			b, err := c.sched.Read(i)
-			if err != nil {
-				c.log.Fatalf("failed to load root page: %v\n", err)
-			}
-			c.ps[i] = &page{b: b, cp: c}
-		}
-	}
 	cnt := 0
 	freeSize := c.n * FreeMultiples
 	ticker := time.NewTicker(Cycle * time.Second)
@@ -3,7 +3,12 @@ package constant
 import "time"
 
 var (
-	CheckPointCycle = 5 * time.Second
+	LockTimeout            = 5 * time.Second
+	CheckPointCycle        = 5 * time.Second
+	TransactionWarnTime    = time.Minute
+	MaxTransactionLifetime = time.Duration(0) // unlimited
+	ExpireCycle            = time.Minute
+	CollapseCycle          = time.Minute
 )
 
 const (
@@ -19,15 +24,24 @@ const (
 )
 
 const (
-	PreLoad = 100
+	PreLoad   = 100
+	SweepSize = 1000 // keys swept or collapsed by a background transaction
+	Descents  = 32   // random descents of the index averaged by an estimate
+
+	MaxSweepDepth = 64 // a sweep resumes after a longer key from its prefix of this length
 )
 
 const (
-	MaxKeySize         = 4074
-	MaxValueSize       = 1 << 16 // 64KB
-	MaxTransactionSize = 1 << 26 // 64MB
-	MaxDataFileSize    = 1 << 40 // 1TB
-	MaxLoadDataSize    = 1 << 10 // 1KB
+	MaxKeySize               = 1<<16 - 1 // limited by the log
+	MaxInlineKeySize         = 4066      // longer keys are stored as the head and the hash of the tail
+	MaxValueSize             = 1 << 23   // 8MB, must fit in a record
+	MaxTransactionSize int64 = 1 << 32   // 4GB, typed to fit on 32-bit platforms
+	MaxSegmentSize           = 1 << 26   // 64MB, size of a log file
+	MaxRecordSize            = 1 << 24   // 16MB, a larger write set is logged by chained records
+	SpillSize                = 1 << 26   // 64MB, values written beyond it are kept in a temporary file
+	MaxDataFileSize          = 1 << 40   // 1TB
+	MaxLoadDataSize          = 1 << 10   // 1KB, default size of a coalesced read of values
+	MaxNamespaces            = 255       // besides the default one, a namespace is tagged by a byte
 )
 
 const (
@@ -3,6 +3,7 @@ package data
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/infinivision/gaeadb/errmsg"
@@ -70,6 +71,28 @@ func (d *data) Read(o uint64) ([]byte, error) {
 	return nil, errmsg.NotExist
 }
 
+func (d *data) NewReader(o uint64) (io.Reader, error) {
+	for i, j := 0, len(d.fs); i < j; i++ {
+		if o < d.fs[i].size {
+			return d.fs[i].newReader(int64(o))
+		}
+		o -= d.fs[i].size
+	}
+	return nil, errmsg.NotExist
+}
+
+// Size returns the length of the value at o, only its header is read.
+func (d *data) Size(o uint64) (int, error) {
+	for i, j := 0, len(d.fs); i < j; i++ {
+		if o < d.fs[i].size {
+			_, n, err := d.fs[i].header(int64(o))
+			return n, err
+		}
+		o -= d.fs[i].size
+	}
+	return 0, errmsg.NotExist
+}
+
 func (d *data) Load(o uint64, size int) ([]byte, error) {
 	for i, j := 0, len(d.fs); i < j; i++ {
 		if o < d.fs[i].size {
@@ -92,7 +115,7 @@ func (d *data) Write(o uint64, data []byte) error {
 }
 
 func (d *data) Alloc(data []byte) (uint64, error) {
-	m := uint64(len(data) + HeaderSize)
+	m := uint64(len(data) + len(header(data)))
 	d.Lock()
 	defer d.Unlock()
 	for {
@@ -111,13 +134,62 @@ func (d *data) Alloc(data []byte) (uint64, error) {
 	}
 }
 
+// Inline returns the index value holding v if v is short enough,
+// an empty value is represented by constant.Empty instead.
+func Inline(v []byte) (uint64, bool) {
+	if len(v) == 0 || len(v) > MaxInlineSize {
+		return 0, false
+	}
+	o := InlineMark | uint64(len(v))<<56
+	for i, c := range v {
+		o |= uint64(c) << (8 * uint(i))
+	}
+	return o, true
+}
+
+// Inlined returns the value held by the index value o.
+func Inlined(o uint64) ([]byte, bool) {
+	if o&InlineMark == 0 {
+		return nil, false
+	}
+	v := make([]byte, (o>>56)&0x7)
+	for i := range v {
+		v[i] = byte(o >> (8 * uint(i)))
+	}
+	return v, true
+}
+
+// Expire prepends the expiry time t in nanoseconds to v.
+func Expire(v []byte, t int64) []byte {
+	buf := make([]byte, 8+len(v))
+	binary.LittleEndian.PutUint64(buf, uint64(t))
+	copy(buf[8:], v)
+	return buf
+}
+
+// Expiry splits a value written by Expire.
+func Expiry(v []byte) (int64, []byte, error) {
+	if len(v) < 8 {
+		return 0, nil, errmsg.ReadFailed
+	}
+	return int64(binary.LittleEndian.Uint64(v)), v[8:], nil
+}
+
 func (d *data) fileName(idx int) string {
 	return fmt.Sprintf("%s%c%v.DAT", d.dir, os.PathSeparator, idx)
 }
 
+// header is the length of data, a value of at least 64KB is stored
+// as a blob whose length follows the Extended mark.
 func header(data []byte) []byte {
-	buf := make([]byte, HeaderSize)
-	binary.LittleEndian.PutUint16(buf, uint16(len(data)))
+	if len(data) < Extended {
+		buf := make([]byte, HeaderSize)
+		binary.LittleEndian.PutUint16(buf, uint16(len(data)))
+		return buf
+	}
+	buf := make([]byte, HeaderSize+4)
+	binary.LittleEndian.PutUint16(buf, Extended)
+	binary.LittleEndian.PutUint32(buf[HeaderSize:], uint32(len(data)))
 	return buf
 }
 
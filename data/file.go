@@ -2,6 +2,7 @@ package data
 
 import (
 	"encoding/binary"
+	"io"
 	"os"
 
 	"github.com/infinivision/gaeadb/constant"
@@ -21,20 +22,41 @@ func (f *file) write(o uint64, data []byte) error {
 }
 
 func (f *file) read(o int64) ([]byte, error) {
+	o, n, err := f.header(o)
+	if err != nil {
+		return nil, err
+	}
+	return read(f.fp, o, n)
+}
+
+func (f *file) newReader(o int64) (io.Reader, error) {
+	o, n, err := f.header(o)
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(f.fp, o, int64(n)), nil
+}
+
+// header returns the offset and the length of the value at o
+func (f *file) header(o int64) (int64, int, error) {
 	if int64(f.size)-o < HeaderSize {
-		return nil, errmsg.NotExist
+		return 0, 0, errmsg.NotExist
 	}
 	h, err := read(f.fp, o, HeaderSize)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
-	return read(f.fp, o+HeaderSize, int(binary.LittleEndian.Uint16(h)))
+	if n := int(binary.LittleEndian.Uint16(h)); n != Extended {
+		return o + HeaderSize, n, nil
+	}
+	if h, err = read(f.fp, o+HeaderSize, 4); err != nil {
+		return 0, 0, err
+	}
+	return o + HeaderSize + 4, int(binary.LittleEndian.Uint32(h)), nil
 }
 
+// load reads size bytes at o at most, the caller bounds size
 func (f *file) load(o int64, size int) ([]byte, error) {
-	if size > constant.MaxLoadDataSize {
-		size = constant.MaxLoadDataSize
-	}
 	if size > int(int64(f.size)-o) {
 		size = int(int64(f.size) - o)
 	}
@@ -1,23 +1,37 @@
 package data
 
 import (
+	"io"
 	"os"
 	"sync"
 )
 
 const (
 	HeaderSize = 2
+	Extended   = 0xFFFF // the length is stored in the following 4 bytes
+	Expiring   = 0xFFFE // the expiry time and the length of a logged value follow
+	Merging    = 0xFFFD // a logged value is a merge operand, its length follows
+	Empty      = 0xFFFC // a logged value is empty, a length of zero is a deletion
 )
 
 const (
 	Magic = "gaeadb"
 )
 
+const (
+	MaxInlineSize = 7
+	InlineMark    = uint64(1) << 63 // the value is held by the index value instead of the data file
+	ExpireMark    = uint64(1) << 62 // the value in the data file starts with its expiry time
+	MergeMark     = uint64(1) << 61 // the value in the data file is a merge operand
+)
+
 type Data interface {
 	Close() error
 	Flush() error
 	Del(uint64) error
 	Read(uint64) ([]byte, error)
+	NewReader(uint64) (io.Reader, error)
+	Size(uint64) (int, error)
 	Write(uint64, []byte) error
 	Alloc([]byte) (uint64, error)
 
@@ -1,16 +1,22 @@
 package db
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/infinivision/gaeadb/cache"
 	"github.com/infinivision/gaeadb/constant"
 	"github.com/infinivision/gaeadb/data"
 	"github.com/infinivision/gaeadb/disk"
+	"github.com/infinivision/gaeadb/errmsg"
 	"github.com/infinivision/gaeadb/locker"
 	"github.com/infinivision/gaeadb/mvcc"
 	"github.com/infinivision/gaeadb/prefix"
@@ -22,10 +28,15 @@ import (
 
 func DefaultConfig() Config {
 	return Config{
-		CacheSize:       2000,
-		DirName:         "gaea.db",
-		LogWriter:       os.Stderr,
-		CheckPointCycle: constant.CheckPointCycle,
+		CacheSize:              2000,
+		DirName:                "gaea.db",
+		LogWriter:              os.Stderr,
+		CheckPointCycle:        constant.CheckPointCycle,
+		LockTimeout:            constant.LockTimeout,
+		TransactionWarnTime:    constant.TransactionWarnTime,
+		MaxTransactionLifetime: constant.MaxTransactionLifetime,
+		ExpireCycle:            constant.ExpireCycle,
+		CollapseCycle:          constant.CollapseCycle,
 	}
 }
 
@@ -41,12 +52,12 @@ func Open(cfg Config) (*db, error) {
 	if err != nil {
 		return nil, err
 	}
-	c, m, err := newMVCC(cfg, log)
+	cs, m, err := newMVCC(cfg, d, log)
 	if err != nil {
 		d.Close()
 		return nil, err
 	}
-	ts, err := wal.Recover(cfg.DirName, d, m, c)
+	ts, err := wal.Recover(cfg.DirName, d, m, cs)
 	if err != nil {
 		d.Close()
 		m.Close()
@@ -55,15 +66,35 @@ func Open(cfg Config) (*db, error) {
 	w, err := wal.NewWriter(cfg.DirName)
 	if err != nil {
 		d.Close()
+		m.Close()
 		return nil, err
 	}
 	constant.CheckPointCycle = cfg.CheckPointCycle
-	schd := scheduler.New(ts, d, c, w)
+	constant.TransactionWarnTime = cfg.TransactionWarnTime
+	constant.MaxTransactionLifetime = cfg.MaxTransactionLifetime
+	lt := locker.NewKeyTable(cfg.LockTimeout)
+	schd := scheduler.New(ts, m.Settled(), cfg.ManagedTimestamp, d, cs, w, lt, log)
 	go schd.Run()
-	return &db{d, m, w, c, log, schd}, nil
+	db := &db{d, m, w, cs, log, schd, lt, cfg.MergeOperators, nil, m.Namespaces()[0], false}
+	mc := cfg.CollapseCycle
+	if len(cfg.MergeOperators) == 0 { // nothing to collapse
+		mc = 0
+	}
+	if (cfg.ExpireCycle > 0 || mc > 0) && !cfg.ManagedTimestamp { // background transactions can not choose commit timestamps
+		db.ch = make(chan struct{})
+		go db.run(cfg.ExpireCycle, mc)
+	}
+	return db, nil
 }
 
 func (db *db) Close() error {
+	if db.sub {
+		return nil
+	}
+	if db.ch != nil {
+		db.ch <- struct{}{}
+		<-db.ch
+	}
 	db.schd.Stop()
 	db.d.Close()
 	db.w.Close()
@@ -72,7 +103,7 @@ func (db *db) Close() error {
 }
 
 func (db *db) Del(k []byte) error {
-	tx := transaction.New(false, db.d, db.m, db.w, db.log, db.schd)
+	tx := transaction.New(false, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
 	defer tx.Rollback()
 	if err := tx.Del(k); err != nil {
 		return err
@@ -80,8 +111,25 @@ func (db *db) Del(k []byte) error {
 	return tx.Commit()
 }
 
+// DeleteRange deletes the keys from start up to end, a nil end is unbounded.
+func (db *db) DeleteRange(start, end []byte) error {
+	return transaction.DeleteRange(db.ns, start, end, db.d, db.m, db.w, db.lt, db.log, db.schd)
+}
+
+// DeletePrefix deletes the keys with prefix pref.
+func (db *db) DeletePrefix(pref []byte) error {
+	end := append([]byte{}, pref...)
+	for len(end) > 0 && end[len(end)-1] == 0xFF {
+		end = end[:len(end)-1]
+	}
+	if len(end) > 0 {
+		end[len(end)-1]++
+	}
+	return transaction.DeleteRange(db.ns, pref, end, db.d, db.m, db.w, db.lt, db.log, db.schd)
+}
+
 func (db *db) Set(k, v []byte) error {
-	tx := transaction.New(false, db.d, db.m, db.w, db.log, db.schd)
+	tx := transaction.New(false, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
 	defer tx.Rollback()
 	if err := tx.Set(k, v); err != nil {
 		return err
@@ -89,8 +137,28 @@ func (db *db) Set(k, v []byte) error {
 	return tx.Commit()
 }
 
+// SetWithTTL sets the value of k which expires after ttl.
+func (db *db) SetWithTTL(k, v []byte, ttl time.Duration) error {
+	tx := transaction.New(false, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
+	defer tx.Rollback()
+	if err := tx.SetWithTTL(k, v, ttl); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Merge merges the operand x into the value of k.
+func (db *db) Merge(k, x []byte) error {
+	tx := transaction.New(false, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
+	defer tx.Rollback()
+	if err := tx.Merge(k, x); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (db *db) Get(k []byte) ([]byte, error) {
-	tx := transaction.New(true, db.d, db.m, db.w, db.log, db.schd)
+	tx := transaction.New(true, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
 	defer tx.Rollback()
 	if v, err := tx.Get(k); err != nil {
 		return nil, err
@@ -99,8 +167,212 @@ func (db *db) Get(k []byte) ([]byte, error) {
 	}
 }
 
-func (db *db) NewTransaction(ro bool) (transaction.Transaction, error) {
-	return transaction.New(ro, db.d, db.m, db.w, db.log, db.schd), nil
+// GetVersion returns the value of k and its version, which is the commit timestamp of the value.
+func (db *db) GetVersion(k []byte) ([]byte, uint64, error) {
+	tx := transaction.New(true, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
+	defer tx.Rollback()
+	return tx.GetVersion(k)
+}
+
+// GetMany returns the values of ks in order, the value of a key which does not exist is nil.
+func (db *db) GetMany(ks [][]byte) ([][]byte, error) {
+	tx := transaction.New(true, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
+	defer tx.Rollback()
+	return tx.GetMany(ks)
+}
+
+// Count returns the number of keys with prefix pref, the keys are scanned without their values.
+func (db *db) Count(pref []byte) (int, error) {
+	tx := transaction.New(true, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
+	defer tx.Rollback()
+	return tx.Count(pref)
+}
+
+// EstimateCount returns the approximate number of keys with prefix pref without a full scan.
+func (db *db) EstimateCount(pref []byte) (uint64, error) {
+	tx := transaction.New(true, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
+	defer tx.Rollback()
+	n, _, err := tx.Estimate(pref)
+	return n, err
+}
+
+// EstimateSize returns the approximate size of the keys with prefix pref and their values without a full scan.
+func (db *db) EstimateSize(pref []byte) (uint64, error) {
+	tx := transaction.New(true, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
+	defer tx.Rollback()
+	_, s, err := tx.Estimate(pref)
+	return s, err
+}
+
+// SetIfAbsent sets the value of k unless k exists.
+func (db *db) SetIfAbsent(k, v []byte) error {
+	return db.compareAndWrite(k, v, func(_ []byte, _ uint64, err error) error {
+		switch {
+		case err == errmsg.NotExist:
+			return nil
+		case err == nil:
+			return errmsg.CompareFailed
+		}
+		return err
+	})
+}
+
+// CompareAndSet sets the value of k if the version of k is ts.
+func (db *db) CompareAndSet(k []byte, ts uint64, v []byte) error {
+	return db.compareAndWrite(k, v, version(ts))
+}
+
+// CompareValueAndSet sets the value of k if the value of k is old.
+func (db *db) CompareValueAndSet(k, old, v []byte) error {
+	return db.compareAndWrite(k, v, func(x []byte, _ uint64, err error) error {
+		switch {
+		case err == errmsg.NotExist:
+			return errmsg.CompareFailed
+		case err == nil && !bytes.Equal(x, old):
+			return errmsg.CompareFailed
+		}
+		return err
+	})
+}
+
+// DeleteIf deletes k if the version of k is ts.
+func (db *db) DeleteIf(k []byte, ts uint64) error {
+	return db.compareAndWrite(k, nil, version(ts))
+}
+
+// compareAndWrite writes v to k, or deletes k if v is nil, when f accepts the current
+// value of k. A concurrent write of k is reported as a transaction conflict.
+func (db *db) compareAndWrite(k, v []byte, f func([]byte, uint64, error) error) error {
+	tx := transaction.New(false, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
+	defer tx.Rollback()
+	if err := f(tx.GetVersion(k)); err != nil {
+		return err
+	}
+	if v == nil {
+		if err := tx.Del(k); err != nil {
+			return err
+		}
+	} else if err := tx.Set(k, v); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func version(ts uint64) func([]byte, uint64, error) error {
+	return func(_ []byte, x uint64, err error) error {
+		switch {
+		case err == errmsg.NotExist:
+			return errmsg.CompareFailed
+		case err == nil && x != ts:
+			return errmsg.CompareFailed
+		}
+		return err
+	}
+}
+
+func (db *db) NewTransaction(ro bool, lvl transaction.Isolation) (transaction.Transaction, error) {
+	return transaction.New(ro, false, lvl, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns), nil
+}
+
+// NewPessimisticTransaction creates a read-write transaction whose writes lock their keys.
+func (db *db) NewPessimisticTransaction(lvl transaction.Isolation) (transaction.Transaction, error) {
+	return transaction.New(false, true, lvl, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns), nil
+}
+
+func (db *db) NewTransactionAt(ro bool, lvl transaction.Isolation, ts uint64) (transaction.Transaction, error) {
+	tx, err := transaction.NewAt(ro, lvl, ts, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops)
+	if err != nil {
+		return nil, err
+	}
+	return tx.In(db.ns), nil
+}
+
+// NewTransactionFromCursor creates a read-only transaction to resume the cursor c by Resume,
+// it reads at the snapshot of c if c keeps its read timestamp.
+func (db *db) NewTransactionFromCursor(c []byte) (transaction.Transaction, error) {
+	tx, err := transaction.NewFromCursor(c, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops)
+	if err != nil {
+		return nil, err
+	}
+	return tx.In(db.ns), nil
+}
+
+// Namespace returns the handle of the namespace name, the empty name is the default
+// namespace. The handle shares the database and closing it does nothing.
+func (db *db) Namespace(name string) (DB, error) {
+	ns, err := db.m.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	x := *db
+	x.ns, x.sub = ns, true
+	return &x, nil
+}
+
+func (db *db) LockStats() locker.Stats {
+	return db.lt.Stats()
+}
+
+// run sweeps the expired keys every ec and collapses the merge operands every mc,
+// both resume after the last key visited before and wrap around at the end. A sweep
+// is skipped while the last pass met no key which expires and no expiring value was
+// written after it started.
+func (db *db) run(ec, mc time.Duration) {
+	var idle, seen bool
+	var pts uint64 // commits up to it are visible to the pass
+	var last, mlast []byte
+	var et, mt <-chan time.Time
+
+	if ec > 0 {
+		ticker := time.NewTicker(ec)
+		defer ticker.Stop()
+		et = ticker.C
+	}
+	if mc > 0 {
+		ticker := time.NewTicker(mc)
+		defer ticker.Stop()
+		mt = ticker.C
+	}
+	for {
+		select {
+		case <-db.ch:
+			db.ch <- struct{}{}
+			return
+		case <-et:
+			if last == nil { // a pass starts
+				if idle && db.m.Expiring() <= pts {
+					break
+				}
+				id, ts := db.schd.Start()
+				db.schd.End(id)
+				pts, seen = ts, false
+			}
+			for {
+				n, k, ok, err := transaction.Sweep(constant.SweepSize, last, db.d, db.m, db.w, db.lt, db.log, db.schd)
+				if err != nil {
+					db.log.Infof("sweep expired keys failed: %v\n", err)
+					break
+				}
+				if seen = seen || ok; k == nil {
+					idle = !seen
+				}
+				if last = k; n < constant.SweepSize {
+					break
+				}
+			}
+		case <-mt:
+			for {
+				n, k, err := transaction.Collapse(constant.SweepSize, mlast, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops)
+				if err != nil {
+					db.log.Infof("collapse merge operands failed: %v\n", err)
+					break
+				}
+				if mlast = k; n < constant.SweepSize {
+					break
+				}
+			}
+		}
+	}
 }
 
 func checkDir(dir string) error {
@@ -120,13 +392,91 @@ func checkDir(dir string) error {
 	return nil
 }
 
-func newMVCC(cfg Config, log logger.Log) (cache.Cache, mvcc.MVCC, error) {
-	d, err := disk.New(fmt.Sprintf("%s%cIDX", cfg.DirName, os.PathSeparator))
+// newMVCC opens the indexes of the namespaces, the default namespace is tagged by
+// zero and the others are tagged in the order of their names.
+func newMVCC(cfg Config, dt data.Data, log logger.Log) ([]cache.Cache, mvcc.Space, error) {
+	var cs []cache.Cache
+	var ms []mvcc.MVCC
+	var ns []mvcc.Namespace
+
+	names, err := namespaces(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, name := range names {
+		opt := cfg.Namespaces[name]
+		if opt.CacheSize <= 0 {
+			opt.CacheSize = cfg.CacheSize
+		}
+		c, m, err := openMVCC(cfg.DirName, name, opt.CacheSize, dt, log)
+		if err != nil {
+			for _, m := range ms {
+				m.Close()
+			}
+			return nil, nil, err
+		}
+		cs, ms = append(cs, c), append(ms, m)
+		ns = append(ns, mvcc.Namespace{Tag: byte(i), Name: name, TTL: opt.TTL})
+	}
+	return cs, mvcc.NewSpace(ms, ns), nil
+}
+
+func openMVCC(dir, name string, size int, dt data.Data, log logger.Log) (cache.Cache, mvcc.MVCC, error) {
+	if len(name) > 0 {
+		name = "." + name
+	}
+	d, err := disk.New(fmt.Sprintf("%s%cIDX%s", dir, os.PathSeparator, name))
 	if err != nil {
 		return nil, nil, err
 	}
-	c := cache.New(cfg.CacheSize, d, log)
-	return c, mvcc.New(prefix.New(c, locker.New())), nil
+	c := cache.New(size, d, log)
+	m, err := mvcc.New(prefix.New(c, locker.New()), dt, fmt.Sprintf("%s%cDEL%s", dir, os.PathSeparator, name))
+	if err != nil {
+		d.Close()
+		return nil, nil, err
+	}
+	return c, m, nil
+}
+
+// namespaces returns the names of the namespaces configured or found in the directory
+// in the order of their tags, the default namespace comes first by the empty name.
+func namespaces(cfg Config) ([]string, error) {
+	mp := make(map[string]struct{})
+	for name, _ := range cfg.Namespaces {
+		mp[name] = struct{}{}
+	}
+	fs, err := filepath.Glob(fmt.Sprintf("%s%cIDX.*", cfg.DirName, os.PathSeparator))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fs {
+		mp[strings.TrimPrefix(filepath.Base(f), "IDX.")] = struct{}{}
+	}
+	names := []string{}
+	for name, _ := range mp {
+		if !validName(name) {
+			return nil, errmsg.InvalidNamespace
+		}
+		names = append(names, name)
+	}
+	if len(names) > constant.MaxNamespaces {
+		return nil, errmsg.InvalidNamespace
+	}
+	sort.Strings(names)
+	return append([]string{""}, names...), nil
+}
+
+// validName reports whether name is made of letters, digits, '_' and '-'
+func validName(name string) bool {
+	if len(name) == 0 || len(name) > 255 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
 }
 
 func enlargelimit() error {
@@ -139,5 +489,4 @@ func enlargelimit() error {
 		rlimit.Cur = rlimit.Max
 		return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlimit)
 	}
-	return nil
 }
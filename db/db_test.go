@@ -0,0 +1,647 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infinivision/gaeadb/constant"
+	"github.com/infinivision/gaeadb/data"
+	"github.com/infinivision/gaeadb/errmsg"
+	"github.com/infinivision/gaeadb/merge"
+	"github.com/infinivision/gaeadb/mvcc"
+	"github.com/infinivision/gaeadb/transaction"
+)
+
+func open(t *testing.T) (*db, func()) {
+	d, _, cleanup := openWith(t, DefaultConfig())
+	return d, cleanup
+}
+
+// openWith opens a database of cfg in a temporary directory which is returned
+func openWith(t *testing.T, cfg Config) (*db, string, func()) {
+	dir, err := ioutil.TempDir("", "gaeadb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DirName = dir
+	d, err := Open(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return d, dir, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// TestScan checks forward and backward scans against a model of the keys,
+// within transactions holding pending writes and after they commit.
+func TestScan(t *testing.T) {
+	d, cleanup := open(t)
+	defer cleanup()
+
+	mp := make(map[string]string) // model
+	for i := 0; i < 100; i++ {
+		k, v := fmt.Sprintf("/u/b/u_%v", i), fmt.Sprintf("%v", i)
+		if err := d.Set([]byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		mp[k] = v
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		tx, err := d.NewTransaction(false, transaction.Serializable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xs := make(map[string]string)
+		for k, v := range mp {
+			xs[k] = v
+		}
+		for j := 0; j < 50; j++ {
+			k := fmt.Sprintf("/u/%c/u_%v", 'a'+r.Intn(3), r.Intn(100))
+			switch r.Intn(3) {
+			case 0:
+				if err := tx.Del([]byte(k)); err != nil {
+					t.Fatal(err)
+				}
+				delete(xs, k)
+			default:
+				v := fmt.Sprintf("%v_%v", i, j)
+				if err := tx.Set([]byte(k), []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+				xs[k] = v
+			}
+		}
+		for _, pref := range []string{"", "/u/a/", "/u/b/", "/u/c/u_1"} {
+			check(t, tx, pref, xs)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		mp = xs
+	}
+	tx, err := d.NewTransaction(true, transaction.Serializable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	check(t, tx, "", mp)
+}
+
+// TestLongPrefix scans prefixes around constant.MaxInlineKeySize, a longer key
+// is kept in the index by its head and the hash of its tail.
+func TestLongPrefix(t *testing.T) {
+	d, cleanup := open(t)
+	defer cleanup()
+
+	mp := make(map[string]string)
+	h := strings.Repeat("h", constant.MaxInlineKeySize+40)
+	for _, k := range []string{h + "a", h + "b", h + "c", h[:constant.MaxInlineKeySize-10] + "x", "short"} {
+		if err := d.Set([]byte(k), []byte(k[len(k)-1:])); err != nil {
+			t.Fatal(err)
+		}
+		mp[k] = k[len(k)-1:]
+	}
+	tx, err := d.NewTransaction(false, transaction.Serializable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, k := range []string{h + "bb", h[:constant.MaxInlineKeySize] + "b"} {
+		if err := tx.Set([]byte(k), []byte("p")); err != nil {
+			t.Fatal(err)
+		}
+		mp[k] = "p"
+	}
+	for _, n := range []int{0, constant.MaxInlineKeySize - 1, constant.MaxInlineKeySize, constant.MaxInlineKeySize + 1, len(h), len(h) + 1} {
+		check(t, tx, (h + "b")[:n], mp)
+	}
+}
+
+// check compares both scan directions of pref with the model
+func check(t *testing.T, tx transaction.Transaction, pref string, mp map[string]string) {
+	var ks []string
+
+	for k, _ := range mp {
+		if strings.HasPrefix(k, pref) {
+			ks = append(ks, k)
+		}
+	}
+	sort.Strings(ks)
+	for _, rev := range []bool{false, true} {
+		var err error
+		var itr transaction.Iterator
+
+		if rev {
+			itr, err = tx.NewBackwardIterator([]byte(pref))
+		} else {
+			itr, err = tx.NewForwardIterator([]byte(pref))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, _ := range ks {
+			k := ks[i]
+			if rev {
+				k = ks[len(ks)-1-i]
+			}
+			if !itr.Valid() {
+				t.Fatalf("scan of '%s' (reverse %v) ends after %v keys, expected %v", pref, rev, i, len(ks))
+			}
+			if string(itr.Key()) != k {
+				t.Fatalf("scan of '%s' (reverse %v) returns '%s' at %v, expected '%s'", pref, rev, itr.Key(), i, k)
+			}
+			if v, err := itr.Value(); err != nil || string(v) != mp[k] {
+				t.Fatalf("value of '%s' is '%s' (%v), expected '%s'", k, v, err, mp[k])
+			}
+			if err := itr.Next(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if itr.Valid() {
+			t.Fatalf("scan of '%s' (reverse %v) returns '%s' after the %v keys expected", pref, rev, itr.Key(), len(ks))
+		}
+		itr.Close()
+	}
+}
+
+// TestDeleteRange checks random range deletions against a model of the keys,
+// a snapshot taken before a deletion keeps seeing the keys while the older
+// deletions are settled.
+func TestDeleteRange(t *testing.T) {
+	d, cleanup := open(t)
+	defer cleanup()
+
+	mp := make(map[string]string)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		var old transaction.Transaction
+
+		xs := make(map[string]string) // seen by old
+		for k, v := range mp {
+			xs[k] = v
+		}
+		if i%10 == 0 {
+			tx, err := d.NewTransaction(true, transaction.Serializable)
+			if err != nil {
+				t.Fatal(err)
+			}
+			old = tx
+		}
+		for j := 0; j < 20; j++ {
+			k, v := fmt.Sprintf("k%03d", r.Intn(200)), fmt.Sprintf("%v_%v", i, j)
+			if err := d.Set([]byte(k), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+			mp[k] = v
+		}
+		start, end := fmt.Sprintf("k%03d", r.Intn(200)), fmt.Sprintf("k%03d", r.Intn(200))
+		if r.Intn(5) == 0 {
+			end = ""
+		}
+		if err := d.DeleteRange([]byte(start), []byte(end)); err != nil {
+			t.Fatal(err)
+		}
+		if end == "" || start < end {
+			for k, _ := range mp {
+				if k >= start && (end == "" || k < end) {
+					delete(mp, k)
+				}
+			}
+		}
+		tx, err := d.NewTransaction(true, transaction.Serializable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, tx, "", mp)
+		check(t, tx, "k1", mp)
+		tx.Rollback()
+		if old != nil {
+			check(t, old, "", xs)
+			old.Rollback()
+		}
+	}
+}
+
+// TestManagedTimestamp checks that a commit timestamp must stay below mvcc.Long,
+// whose bit marks the versions of long keys.
+func TestManagedTimestamp(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ManagedTimestamp = true
+	d, _, cleanup := openWith(t, cfg)
+	defer cleanup()
+
+	for _, x := range []struct {
+		ts  uint64
+		err error
+	}{
+		{mvcc.Long, errmsg.InvalidTimestamp},
+		{mvcc.Long - 1, nil},
+	} {
+		tx, err := d.NewTransactionAt(false, transaction.Serializable, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Set([]byte("k"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.CommitAt(x.ts); err != x.err {
+			t.Fatalf("commit at %x returns %v, expected %v", x.ts, err, x.err)
+		}
+		tx.Rollback()
+	}
+	tx, err := d.NewTransactionAt(true, transaction.Serializable, mvcc.Long-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if v, err := tx.Get([]byte("k")); err != nil || string(v) != "v" {
+		t.Fatalf("get returns '%s' (%v), expected 'v'", v, err)
+	}
+}
+
+// TestSettledSnapshot checks that a snapshot cursor can not be resumed below
+// the settled range deletions, it would see the keys of a dropped deletion.
+func TestSettledSnapshot(t *testing.T) {
+	d, cleanup := open(t)
+	defer cleanup()
+
+	for _, k := range []string{"a", "b", "c"} {
+		if err := d.Set([]byte(k), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := d.NewTransaction(true, transaction.Serializable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	itr, err := tx.NewIterator(nil, transaction.IteratorOptions{Snapshot: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := itr.Next(); err != nil {
+		t.Fatal(err)
+	}
+	c := itr.Cursor()
+	itr.Close()
+	if err := d.DeleteRange([]byte("a"), []byte("c")); err != nil { // settled after the snapshot ends
+		t.Fatal(err)
+	}
+	rtx, err := d.NewTransactionFromCursor(c)
+	if err != nil {
+		t.Fatalf("resume while the snapshot lives: %v", err)
+	}
+	rtx.Rollback()
+	tx.Rollback()
+	if err := d.DeletePrefix(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.NewTransactionFromCursor(c); err != errmsg.InvalidTimestamp {
+		t.Fatalf("resume below the settled deletions returns %v, expected %v", err, errmsg.InvalidTimestamp)
+	}
+}
+
+// TestCollapse checks that the merge operands are collapsed in batches resuming
+// after the last key, the values read stay the same.
+func TestCollapse(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CollapseCycle = 0
+	cfg.MergeOperators = merge.Operators{"c/": merge.Add}
+	d, _, cleanup := openWith(t, cfg)
+	defer cleanup()
+
+	ks := []string{"c/a", "c/b", "c/c"}
+	for i := 0; i < 3; i++ {
+		for _, k := range ks {
+			if err := d.Merge([]byte(k), merge.Int64(1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var last []byte
+	for _, x := range []struct {
+		n    int
+		last string
+	}{{2, "\x00c/b"}, {1, ""}, {0, ""}} {
+		n, k, err := transaction.Collapse(2, last, d.d, d.m, d.w, d.lt, d.log, d.schd, d.ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != x.n || string(k) != x.last {
+			t.Fatalf("collapse returns %v keys up to '%q', expected %v up to '%q'", n, k, x.n, x.last)
+		}
+		last = k
+	}
+	for _, k := range ks {
+		v, err := d.Get([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := merge.ToInt64(v); err != nil || n != 3 {
+			t.Fatalf("'%s' is %v (%v), expected 3", k, n, err)
+		}
+		if o, _, err := d.m.Get(append([]byte{0}, k...), math.MaxInt64); err != nil || o&data.MergeMark != 0 {
+			t.Fatalf("'%s' is not collapsed (%v)", k, err)
+		}
+	}
+}
+
+// TestSweepExpiring checks what the sweeper relies on to skip a pass,
+// the writes of expiring values and the expiring keys met by a sweep.
+func TestSweepExpiring(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ExpireCycle = 0
+	d, _, cleanup := openWith(t, cfg)
+	defer cleanup()
+
+	for i := 0; i < 10; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("k%v", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ts := d.m.Expiring(); ts != 0 {
+		t.Fatalf("expiring value written at %v, expected none", ts)
+	}
+	if _, _, ok, err := transaction.Sweep(constant.SweepSize, nil, d.d, d.m, d.w, d.lt, d.log, d.schd); err != nil || ok {
+		t.Fatalf("sweep meets an expiring key (%v)", err)
+	}
+	if err := d.SetWithTTL([]byte("k3"), []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if d.m.Expiring() == 0 {
+		t.Fatal("expiring value is not counted")
+	}
+	n, k, ok, err := transaction.Sweep(constant.SweepSize, nil, d.d, d.m, d.w, d.lt, d.log, d.schd)
+	if err != nil || n != 0 || k != nil || !ok {
+		t.Fatalf("sweep returns %v keys, '%s', %v (%v), expected the expiring key to be met", n, k, ok, err)
+	}
+}
+
+// TestRedo replays the log into an empty index as after a crash before the index
+// is written, a deletion and an empty value must keep their meaning.
+func TestRedo(t *testing.T) {
+	d, src, cleanup := openWith(t, DefaultConfig())
+	defer cleanup()
+
+	for _, x := range []struct{ k, v string }{{"k", "v"}, {"e", "v"}, {"e", ""}} {
+		if err := d.Set([]byte(x.k), []byte(x.v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Del([]byte("k")); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gaeadb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	buf, err := ioutil.ReadFile(filepath.Join(src, "0.LOG"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "0.LOG"), buf, 0664); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.DirName = dir
+	x, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	if v, err := x.Get([]byte("k")); err != errmsg.NotExist {
+		t.Fatalf("deleted key reads '%s' (%v)", v, err)
+	}
+	if v, err := x.Get([]byte("e")); err != nil || v == nil || len(v) != 0 {
+		t.Fatalf("empty value reads '%s' (%v)", v, err)
+	}
+}
+
+// TestWriteSkew checks that a write skew aborts under Serializable and commits under
+// SnapshotIsolation, where the second of two writes of a key still aborts.
+func TestWriteSkew(t *testing.T) {
+	for _, x := range []struct {
+		lvl  transaction.Isolation
+		fail bool
+	}{{transaction.Serializable, true}, {transaction.SnapshotIsolation, false}} {
+		d, cleanup := open(t)
+		for _, k := range []string{"x", "y"} {
+			if err := d.Set([]byte(k), []byte("1")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tx, err := d.NewTransaction(false, x.lvl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ty, err := d.NewTransaction(false, x.lvl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"x", "y"} { // both keys are checked by both transactions
+			if _, err := tx.Get([]byte(k)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ty.Get([]byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Set([]byte("x"), []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+		if err := ty.Set([]byte("y"), []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		err = ty.Commit()
+		switch {
+		case x.fail && !errmsg.IsConflict(err):
+			t.Fatalf("write skew under %v commits: %v", x.lvl, err)
+		case x.fail && err.(*errmsg.ConflictError).Key != "x":
+			t.Fatalf("write skew under %v fails on the wrong key: %v", x.lvl, err)
+		case !x.fail && err != nil:
+			t.Fatalf("write skew under %v fails: %v", x.lvl, err)
+		}
+
+		tx, err = d.NewTransaction(false, x.lvl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ty, err = d.NewTransaction(false, x.lvl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Set([]byte("z"), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if err := ty.Set([]byte("z"), []byte("y")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ty.Commit(); !errmsg.IsConflict(err) || err.(*errmsg.ConflictError).Key != "z" {
+			t.Fatalf("second write of a key under %v returns %v", x.lvl, err)
+		}
+		cleanup()
+	}
+}
+
+// TestPhantom checks that a key written into the range scanned by a transaction aborts it
+// once a transaction reading its write commits as well, a partial scan covers the keys up
+// to the last one read ahead.
+func TestPhantom(t *testing.T) {
+	d, cleanup := open(t)
+	defer cleanup()
+
+	if err := d.Set([]byte("s"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	for i, x := range []struct {
+		rev   bool
+		n     int    // keys read, all of them if negative
+		start string // a key written, or the start of a deletion up to end
+		end   string
+		fail  bool
+	}{
+		{false, -1, "a", "", true}, // before the first key of the prefix
+		{false, -1, "z", "", true}, // after the last one
+		{false, 1, "a", "", true},
+		{false, 1, "c", "", false},
+		{true, -1, "a", "", true},
+		{true, 1, "g", "", true},
+		{true, 1, "e", "", false},
+		{false, 1, "a", "c", true},
+		{false, 1, "c", "e", false},
+		{true, 1, "c", "g", true},
+		{true, 1, "c", "f", false}, // the end is not deleted
+	} {
+		pref := fmt.Sprintf("%v/", i)
+		for _, k := range []string{"b", "d", "f"} {
+			if err := d.Set([]byte(pref+k), []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tx, err := d.NewTransaction(false, transaction.Serializable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		itr, err := tx.NewIterator([]byte(pref), transaction.IteratorOptions{Reverse: x.rev, BatchSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 1; itr.Valid() && (x.n < 0 || j < x.n); j++ {
+			if err := itr.Next(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		itr.Close()
+		switch {
+		case x.end == "":
+			err = d.Set([]byte(pref+x.start), []byte("v"))
+		default:
+			err = d.DeleteRange([]byte(pref+x.start), []byte(pref+x.end))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ty, err := d.NewTransaction(false, transaction.Serializable) // the scanner is a pivot
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ty.Get([]byte("s")); err != nil {
+			t.Fatal(err)
+		}
+		if err := ty.Set([]byte("r"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := ty.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Set([]byte("s"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		switch err := tx.Commit(); {
+		case x.fail && !errmsg.IsConflict(err):
+			t.Fatalf("%v: a write of %v-%v into the scanned range commits: %v", i, x.start, x.end, err)
+		case !x.fail && err != nil:
+			t.Fatalf("%v: a write of %v-%v outside the scanned range fails: %v", i, x.start, x.end, err)
+		}
+	}
+}
+
+// TestLock checks that a lock wait closing a cycle fails with Deadlock and a lock
+// wait longer than the timeout fails with LockTimeout.
+func TestLock(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.LockTimeout = 200 * time.Millisecond
+	d, _, cleanup := openWith(t, cfg)
+	defer cleanup()
+
+	tx, err := d.NewPessimisticTransaction(transaction.Serializable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	ty, err := d.NewPessimisticTransaction(transaction.Serializable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Lock([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ty.Lock([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan error)
+	go func() { ch <- tx.Lock([]byte("b")) }()
+	for d.LockStats().Waits == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := ty.GetForUpdate([]byte("a")); err != errmsg.Deadlock {
+		t.Fatalf("lock closing a cycle returns %v, expected %v", err, errmsg.Deadlock)
+	}
+	ty.Rollback()
+	if err := <-ch; err != nil {
+		t.Fatalf("lock released by rollback returns %v", err)
+	}
+
+	tz, err := d.NewPessimisticTransaction(transaction.Serializable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tz.Rollback()
+	start := time.Now()
+	if _, err := tz.GetForUpdate([]byte("a")); err != errmsg.LockTimeout {
+		t.Fatalf("lock held by another transaction returns %v, expected %v", err, errmsg.LockTimeout)
+	}
+	if time.Since(start) < cfg.LockTimeout {
+		t.Fatalf("lock wait times out after %v, expected %v", time.Since(start), cfg.LockTimeout)
+	}
+	if err := tx.Set([]byte("a"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tz.GetForUpdate([]byte("a")); err != nil || string(v) != "v" {
+		t.Fatalf("lock released by commit reads '%s' (%v)", v, err)
+	}
+	if st := d.LockStats(); st.Deadlocks != 1 || st.Timeouts != 1 {
+		t.Fatalf("lock stats %+v, expected a deadlock and a timeout", st)
+	}
+}
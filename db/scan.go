@@ -0,0 +1,149 @@
+package db
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/infinivision/gaeadb/constant"
+	"github.com/infinivision/gaeadb/errmsg"
+	"github.com/infinivision/gaeadb/transaction"
+)
+
+// ParallelScan calls fn with the keys with prefix pref and their values read at a
+// single timestamp. The keys are split by the byte following pref into 256 parts
+// scanned by workers concurrently. If ordered is false fn is called by the workers
+// concurrently, otherwise fn is called by one goroutine in key order. The scan stops
+// at the first error returned by fn or met by a worker, which is returned.
+func (db *db) ParallelScan(pref []byte, workers int, ordered bool, fn func([]byte, []byte) error) error {
+	if workers <= 0 {
+		workers = 1
+	}
+	tx := transaction.New(true, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
+	defer tx.Rollback()
+	if len(pref) > 0 { // pref itself precedes the parts
+		switch v, err := tx.Get(pref); {
+		case err == nil:
+			if err := fn(append([]byte{}, pref...), v); err != nil {
+				return err
+			}
+		case err != errmsg.NotExist:
+			return err
+		}
+	}
+	s := &scan{
+		tx:   tx,
+		pref: pref,
+		done: make(chan struct{}),
+	}
+	if ordered {
+		for i, _ := range s.chs {
+			s.chs[i] = make(chan *pair, constant.PreLoad)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(fn, ordered)
+		}()
+	}
+	if ordered {
+		s.drain(fn)
+	}
+	wg.Wait()
+	return s.err
+}
+
+// work scans the parts in order until all are taken, a part is sent to its channel
+// if the scan is ordered.
+func (s *scan) work(fn func([]byte, []byte) error, ordered bool) {
+	for {
+		s.Lock()
+		i := s.n
+		s.n++
+		s.Unlock()
+		if i >= len(s.chs) {
+			return
+		}
+		err := s.part(i, func(k, v []byte) error {
+			if !ordered {
+				return fn(k, v)
+			}
+			select {
+			case s.chs[i] <- &pair{k, v}:
+				return nil
+			case <-s.done:
+				return errmsg.ScanEnd
+			}
+		})
+		if ordered {
+			close(s.chs[i])
+		}
+		if err != nil {
+			if err != errmsg.ScanEnd {
+				s.fail(err)
+			}
+			return
+		}
+	}
+}
+
+// part calls f with the keys of the part i
+func (s *scan) part(i int, f func([]byte, []byte) error) error {
+	pref := append(append([]byte{}, s.pref...), byte(i))
+	itr, err := s.tx.NewForwardIterator(pref)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+	for itr.Valid() {
+		select {
+		case <-s.done:
+			return errmsg.ScanEnd
+		default:
+		}
+		switch v, err := itr.Value(); {
+		case !bytes.HasPrefix(itr.Key(), pref): // the iterator may return pref without its last byte
+		case err == nil:
+			if err := f(itr.Key(), v); err != nil {
+				return err
+			}
+		case err != errmsg.NotExist: // a deleted key is skipped
+			return err
+		}
+		if err := itr.Next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drain calls fn with the keys of the parts in order
+func (s *scan) drain(fn func([]byte, []byte) error) {
+	for i := 0; i < len(s.chs); {
+		select {
+		case p, ok := <-s.chs[i]:
+			if !ok {
+				i++
+				continue
+			}
+			if err := fn(p.k, p.v); err != nil {
+				s.fail(err)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// fail records the first error and stops the workers
+func (s *scan) fail(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err == nil {
+		s.err = err
+		close(s.done)
+	}
+}
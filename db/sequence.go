@@ -0,0 +1,93 @@
+package db
+
+import (
+	"encoding/binary"
+
+	"github.com/infinivision/gaeadb/errmsg"
+	"github.com/infinivision/gaeadb/transaction"
+)
+
+// Sequence returns a generator of the ids stored at k which leases n ids at a time,
+// errmsg.InvalidSequence is returned if n is zero or k holds another value
+// and errmsg.SequenceExhausted once a lease would pass the largest id.
+func (db *db) Sequence(k []byte, n uint64) (Sequence, error) {
+	if n == 0 {
+		return nil, errmsg.InvalidSequence
+	}
+	seq := &sequence{db: db, k: append([]byte{}, k...), n: n}
+	if err := seq.lease(); err != nil {
+		return nil, err
+	}
+	return seq, nil
+}
+
+func (seq *sequence) Next() (uint64, error) {
+	seq.Lock()
+	defer seq.Unlock()
+	if seq.next == seq.end {
+		if err := seq.lease(); err != nil {
+			return 0, err
+		}
+	}
+	id := seq.next
+	seq.next++
+	return id, nil
+}
+
+// Release returns the unused ids of the lease unless ids were leased after it.
+func (seq *sequence) Release() error {
+	seq.Lock()
+	defer seq.Unlock()
+	err := seq.db.CompareValueAndSet(seq.k, encode(seq.end), encode(seq.next))
+	switch {
+	case err == errmsg.CompareFailed || errmsg.IsConflict(err):
+		err = nil
+	case err == nil:
+		seq.end = seq.next
+	}
+	return err
+}
+
+// lease moves the high-water mark stored at k by n, the ids below it are handed out.
+func (seq *sequence) lease() error {
+	for {
+		next, err := seq.advance()
+		switch {
+		case err == nil:
+			seq.next, seq.end = next, next+seq.n
+			return nil
+		case !errmsg.IsConflict(err):
+			return err
+		}
+	}
+}
+
+func (seq *sequence) advance() (uint64, error) {
+	var next uint64
+
+	db := seq.db
+	tx := transaction.New(false, false, transaction.Serializable, db.d, db.m, db.w, db.lt, db.log, db.schd, db.ops).In(db.ns)
+	defer tx.Rollback()
+	switch v, err := tx.Get(seq.k); {
+	case err == errmsg.NotExist:
+	case err != nil:
+		return 0, err
+	case len(v) != 8:
+		return 0, errmsg.InvalidSequence
+	default:
+		next = binary.LittleEndian.Uint64(v)
+	}
+	if next+seq.n < next {
+		return 0, errmsg.SequenceExhausted
+	}
+	if err := tx.Set(seq.k, encode(next+seq.n)); err != nil {
+		return 0, err
+	}
+	return next, tx.Commit()
+}
+
+func encode(n uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, n)
+	return buf
+}
@@ -2,10 +2,13 @@ package db
 
 import (
 	"io"
+	"sync"
 	"time"
 
 	"github.com/infinivision/gaeadb/cache"
 	"github.com/infinivision/gaeadb/data"
+	"github.com/infinivision/gaeadb/locker"
+	"github.com/infinivision/gaeadb/merge"
 	"github.com/infinivision/gaeadb/mvcc"
 	"github.com/infinivision/gaeadb/scheduler"
 	"github.com/infinivision/gaeadb/transaction"
@@ -21,23 +24,100 @@ type DB interface {
 
 	Del([]byte) error
 	Set([]byte, []byte) error
+	SetWithTTL([]byte, []byte, time.Duration) error
+	Merge([]byte, []byte) error
+	DeleteRange([]byte, []byte) error
+	DeletePrefix([]byte) error
 	Get([]byte) ([]byte, error)
+	GetVersion([]byte) ([]byte, uint64, error)
+	GetMany([][]byte) ([][]byte, error)
 
-	NewTransaction(bool) (transaction.Transaction, error)
+	SetIfAbsent([]byte, []byte) error
+	CompareAndSet([]byte, uint64, []byte) error
+	CompareValueAndSet([]byte, []byte, []byte) error
+	DeleteIf([]byte, uint64) error
+
+	Sequence([]byte, uint64) (Sequence, error)
+
+	ParallelScan([]byte, int, bool, func([]byte, []byte) error) error
+	Count([]byte) (int, error)
+	EstimateCount([]byte) (uint64, error)
+	EstimateSize([]byte) (uint64, error)
+
+	NewTransaction(bool, transaction.Isolation) (transaction.Transaction, error)
+	NewTransactionAt(bool, transaction.Isolation, uint64) (transaction.Transaction, error)
+	NewPessimisticTransaction(transaction.Isolation) (transaction.Transaction, error)
+	NewTransactionFromCursor([]byte) (transaction.Transaction, error)
+
+	Namespace(string) (DB, error)
+
+	LockStats() locker.Stats
+}
+
+// Sequence hands out increasing ids leased from a key, an id is never handed out
+// twice even after a crash, but the unused ids of a lease are skipped unless released.
+type Sequence interface {
+	Next() (uint64, error)
+	Release() error
 }
 
 type Config struct {
-	CacheSize       int // cache size
-	DirName         string
-	LogWriter       io.Writer
-	CheckPointCycle time.Duration
+	CacheSize              int // cache size
+	DirName                string
+	LogWriter              io.Writer
+	CheckPointCycle        time.Duration
+	ManagedTimestamp       bool // read and commit timestamps are supplied by application
+	LockTimeout            time.Duration
+	TransactionWarnTime    time.Duration // running transactions older than it are logged
+	MaxTransactionLifetime time.Duration // running transactions older than it are aborted, zero is unlimited
+	ExpireCycle            time.Duration // expired keys are swept every cycle, zero disables the sweeper
+	MergeOperators         merge.Operators
+	CollapseCycle          time.Duration               // merge operands are collapsed every cycle, zero disables it
+	Namespaces             map[string]NamespaceOptions // the namespaces in DirName which are not listed are opened by default
+}
+
+// NamespaceOptions tunes a namespace, which is kept by its own index
+// files IDX.<name> and DEL.<name> and shares the log with the others.
+type NamespaceOptions struct {
+	CacheSize int           // Config.CacheSize by default
+	TTL       time.Duration // values set without a ttl expire after it, zero is unlimited
+}
+
+type sequence struct {
+	sync.Mutex
+	db   *db
+	k    []byte
+	n    uint64 // lease size
+	next uint64
+	end  uint64 // end of the lease
+}
+
+// scan is a parallel scan of the keys with prefix pref
+type scan struct {
+	sync.Mutex
+	n    int // next part
+	err  error
+	tx   transaction.Transaction
+	pref []byte
+	chs  [256]chan *pair // keys of the parts of an ordered scan
+	done chan struct{}
+}
+
+type pair struct {
+	k []byte
+	v []byte
 }
 
 type db struct {
 	d    data.Data
-	m    mvcc.MVCC
+	m    mvcc.Space
 	w    wal.Writer
-	c    cache.Cache
+	cs   []cache.Cache // caches of the indexes of the namespaces
 	log  logger.Log
 	schd scheduler.Scheduler
+	lt   locker.KeyTable
+	ops  merge.Operators
+	ch   chan struct{} // nil if no background work is running
+	ns   mvcc.Namespace
+	sub  bool // a handle of a namespace, closed with the database
 }
@@ -0,0 +1,27 @@
+package errmsg
+
+import "fmt"
+
+func NewConflict(k string) error {
+	return &ConflictError{Key: k}
+}
+
+func (e *ConflictError) Error() string {
+	if len(e.Namespace) > 0 {
+		return fmt.Sprintf("%v on '%s' in namespace '%s'", TransactionConflict, e.Key, e.Namespace)
+	}
+	return fmt.Sprintf("%v on '%s'", TransactionConflict, e.Key)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return TransactionConflict
+}
+
+// IsConflict reports whether err is caused by a transaction conflict.
+func IsConflict(err error) bool {
+	if err == TransactionConflict {
+		return true
+	}
+	_, ok := err.(*ConflictError)
+	return ok
+}
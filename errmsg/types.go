@@ -13,6 +13,32 @@ var (
 	ValTooLong          = errors.New("value too long")
 	OutOfSpace          = errors.New("out of space")
 	UnknownError        = errors.New("unknown error")
+	DatabaseClosed      = errors.New("database closed")
 	TransactionConflict = errors.New("transaction conflict")
 	ReadOnlyTransaction = errors.New("read-only transaction")
+	InvalidTimestamp    = errors.New("invalid timestamp")
+	Deadlock            = errors.New("deadlock")
+	LockTimeout         = errors.New("lock wait timeout")
+	InvalidSavepoint    = errors.New("invalid savepoint")
+	InvalidTTL          = errors.New("invalid ttl")
+	CompareFailed       = errors.New("compare failed")
+	NoMergeOperator     = errors.New("no merge operator")
+	InvalidOperand      = errors.New("invalid operand")
+	InvalidSequence     = errors.New("invalid sequence")
+	SequenceExhausted   = errors.New("sequence exhausted")
+	InvalidCursor       = errors.New("invalid cursor")
+	InvalidNamespace    = errors.New("invalid namespace")
+	UnknownNamespace    = errors.New("unknown namespace")
+	UnsupportedType     = errors.New("unsupported type")
+	InvalidTuple        = errors.New("invalid tuple")
+	TransactionExpired  = errors.New("transaction expired")
+	ManagedTimestamp    = errors.New("timestamp is managed by application")
+	UnmanagedTimestamp  = errors.New("timestamp is not managed by application")
 )
+
+// ConflictError names the key on which a transaction conflict was detected
+// and its namespace, empty for the default one, it unwraps to TransactionConflict.
+type ConflictError struct {
+	Key       string
+	Namespace string
+}
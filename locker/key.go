@@ -0,0 +1,108 @@
+package locker
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/infinivision/gaeadb/errmsg"
+)
+
+func NewKeyTable(timeout time.Duration) *keyTable {
+	return &keyTable{
+		to:  timeout,
+		wfg: make(map[uint64]uint64),
+		mp:  make(map[string]*keyLock),
+		hmp: make(map[uint64][]string),
+	}
+}
+
+// Lock acquires the exclusive lock of k for owner, owners are the ids
+// of transactions given by the scheduler. The lock is reentrant and
+// held until Release. A wait which would close a cycle in the wait-for graph
+// fails with errmsg.Deadlock, a wait longer than the timeout fails with errmsg.LockTimeout.
+func (t *keyTable) Lock(owner uint64, k string) error {
+	var start time.Time
+	var timer *time.Timer
+
+	for {
+		t.mu.Lock()
+		l, ok := t.mp[k]
+		switch {
+		case !ok:
+			t.mp[k] = &keyLock{owner: owner, ch: make(chan struct{})}
+			t.hmp[owner] = append(t.hmp[owner], k)
+			delete(t.wfg, owner)
+			t.mu.Unlock()
+			if timer != nil {
+				timer.Stop()
+				atomic.AddInt64(&t.st.WaitTime, int64(time.Now().Sub(start)))
+			}
+			return nil
+		case l.owner == owner:
+			t.mu.Unlock()
+			return nil
+		}
+		if t.cycle(owner, l.owner) {
+			delete(t.wfg, owner)
+			t.mu.Unlock()
+			atomic.AddUint64(&t.st.Deadlocks, 1)
+			return errmsg.Deadlock
+		}
+		t.wfg[owner] = l.owner
+		t.mu.Unlock()
+		if timer == nil {
+			start = time.Now()
+			timer = time.NewTimer(t.to)
+			atomic.AddUint64(&t.st.Waits, 1)
+		}
+		select {
+		case <-l.ch:
+		case <-timer.C:
+			t.mu.Lock()
+			delete(t.wfg, owner)
+			t.mu.Unlock()
+			atomic.AddUint64(&t.st.Timeouts, 1)
+			atomic.AddInt64(&t.st.WaitTime, int64(time.Now().Sub(start)))
+			return errmsg.LockTimeout
+		}
+	}
+}
+
+// Release releases all locks held by owner.
+func (t *keyTable) Release(owner uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, k := range t.hmp[owner] {
+		if l, ok := t.mp[k]; ok && l.owner == owner {
+			delete(t.mp, k)
+			close(l.ch)
+		}
+	}
+	delete(t.hmp, owner)
+	delete(t.wfg, owner)
+}
+
+func (t *keyTable) Stats() Stats {
+	return Stats{
+		Waits:     atomic.LoadUint64(&t.st.Waits),
+		Timeouts:  atomic.LoadUint64(&t.st.Timeouts),
+		Deadlocks: atomic.LoadUint64(&t.st.Deadlocks),
+		WaitTime:  atomic.LoadInt64(&t.st.WaitTime),
+	}
+}
+
+// cycle reports whether owner is reachable from holder in the wait-for graph
+func (t *keyTable) cycle(owner, holder uint64) bool {
+	for {
+		switch {
+		case holder == owner:
+			return true
+		default:
+			next, ok := t.wfg[holder]
+			if !ok {
+				return false
+			}
+			holder = next
+		}
+	}
+}
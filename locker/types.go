@@ -4,6 +4,7 @@ import (
 	"container/list"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -37,6 +38,35 @@ type Table interface {
 	Get(uint64) Locker
 }
 
+// KeyTable holds the exclusive key locks of pessimistic transactions
+type KeyTable interface {
+	Release(uint64)
+	Lock(uint64, string) error
+	Stats() Stats
+}
+
+// Stats are the metrics of lock waits, WaitTime is in nanoseconds
+type Stats struct {
+	Waits     uint64
+	Timeouts  uint64
+	Deadlocks uint64
+	WaitTime  int64
+}
+
+type keyLock struct {
+	owner uint64
+	ch    chan struct{} // closed on release
+}
+
+type keyTable struct {
+	mu  sync.Mutex
+	to  time.Duration // lock wait timeout
+	st  Stats
+	wfg map[uint64]uint64 // wait-for graph
+	mp  map[string]*keyLock
+	hmp map[uint64][]string // locks held by owner
+}
+
 type locker struct {
 	t       int   // type
 	n       int32 // refer
@@ -0,0 +1,126 @@
+package merge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/infinivision/gaeadb/errmsg"
+)
+
+// Find returns the operator of k, it is nil if none is bound to a prefix of k.
+func (ops Operators) Find(k []byte) Operator {
+	var n int
+	var op Operator
+
+	for pref, x := range ops {
+		if len(pref) >= n && bytes.HasPrefix(k, []byte(pref)) {
+			n, op = len(pref), x
+		}
+	}
+	return op
+}
+
+// Int64 encodes an operand of Add and Max.
+func Int64(n int64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(n))
+	return buf
+}
+
+// ToInt64 decodes a value of Add and Max.
+func ToInt64(v []byte) (int64, error) {
+	if len(v) != 8 {
+		return 0, errmsg.InvalidOperand
+	}
+	return int64(binary.LittleEndian.Uint64(v)), nil
+}
+
+// Set encodes the elements of a set as an operand of Union.
+func Set(xs ...[]byte) []byte {
+	xs = append([][]byte{}, xs...)
+	sort.Slice(xs, func(i, j int) bool { return bytes.Compare(xs[i], xs[j]) < 0 })
+	var buf []byte
+	for i, x := range xs {
+		if i > 0 && bytes.Equal(x, xs[i-1]) {
+			continue
+		}
+		buf = append(buf, byte(len(x)), byte(len(x)>>8), byte(len(x)>>16), byte(len(x)>>24))
+		buf = append(buf, x...)
+	}
+	return buf
+}
+
+// Elements decodes a value of Union.
+func Elements(v []byte) ([][]byte, error) {
+	var xs [][]byte
+
+	for len(v) > 0 {
+		if len(v) < 4 {
+			return nil, errmsg.InvalidOperand
+		}
+		n := int(binary.LittleEndian.Uint32(v))
+		if v = v[4:]; len(v) < n {
+			return nil, errmsg.InvalidOperand
+		}
+		xs = append(xs, v[:n])
+		v = v[n:]
+	}
+	return xs, nil
+}
+
+func (op *add) Merge(v []byte, xs [][]byte) ([]byte, error) {
+	var sum int64
+
+	for _, x := range append([][]byte{v}, xs...) {
+		if x == nil {
+			continue
+		}
+		n, err := ToInt64(x)
+		if err != nil {
+			return nil, err
+		}
+		sum += n
+	}
+	return Int64(sum), nil
+}
+
+func (op *appender) Merge(v []byte, xs [][]byte) ([]byte, error) {
+	buf := append([]byte{}, v...)
+	for _, x := range xs {
+		buf = append(buf, x...)
+	}
+	return buf, nil
+}
+
+func (op *max) Merge(v []byte, xs [][]byte) ([]byte, error) {
+	var r []byte
+	var m int64
+
+	for _, x := range append([][]byte{v}, xs...) {
+		if x == nil {
+			continue
+		}
+		n, err := ToInt64(x)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil || n > m {
+			r, m = x, n
+		}
+	}
+	return r, nil
+}
+
+func (op *union) Merge(v []byte, xs [][]byte) ([]byte, error) {
+	var ys [][]byte
+
+	for _, x := range append([][]byte{v}, xs...) {
+		zs, err := Elements(x)
+		if err != nil {
+			return nil, err
+		}
+		ys = append(ys, zs...)
+	}
+	return Set(ys...), nil
+}
@@ -0,0 +1,26 @@
+package merge
+
+// Operator combines the value of a key with the operands merged into it in commit order,
+// the value is nil if the key does not exist. An operator must be associative because
+// the operands merged by one transaction are combined before they are written.
+type Operator interface {
+	Merge([]byte, [][]byte) ([]byte, error)
+}
+
+// Operators binds operators to key prefixes, the longest prefix wins.
+type Operators map[string]Operator
+
+type add struct{}
+
+type appender struct{}
+
+type max struct{}
+
+type union struct{}
+
+var (
+	Add    = &add{}      // sum of little-endian int64
+	Append = &appender{} // concatenation
+	Max    = &max{}      // maximum of little-endian int64
+	Union  = &union{}    // union of sets encoded by Set
+)
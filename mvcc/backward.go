@@ -2,7 +2,7 @@ package mvcc
 
 import (
 	"bytes"
-	"encoding/binary"
+	"sort"
 
 	"github.com/infinivision/gaeadb/constant"
 	"github.com/infinivision/gaeadb/errmsg"
@@ -13,62 +13,50 @@ func (itr *backwardIterator) Close() error {
 }
 
 func (itr *backwardIterator) Next() error {
-	if itr.s {
-		itr.s = false
-		return itr.seek()
+	if itr.es = itr.es[1:]; len(itr.es) > 0 {
+		return nil
 	}
-	itr.itr.Next()
 	return itr.seek()
 }
 
 func (itr *backwardIterator) Valid() bool {
-	if itr.s {
-		return true
-	}
-	return itr.itr.Valid()
+	return len(itr.es) > 0
 }
 
 func (itr *backwardIterator) Key() []byte {
-	return itr.e.k
+	return itr.es[0].k
 }
 
 func (itr *backwardIterator) Value() uint64 {
-	return itr.e.v
+	return itr.es[0].v
 }
 
 func (itr *backwardIterator) Timestamp() uint64 {
-	return itr.e.ts
+	return itr.es[0].ts
 }
 
 func (itr *backwardIterator) seek() error {
 	for itr.itr.Valid() {
-		if ts := binary.BigEndian.Uint64(itr.itr.Key()[len(itr.itr.Key())-8:]); ts <= itr.ts && itr.itr.Value() != constant.Cancel {
-			itr.s = true
-			return itr.filter(itr.itr.Key()[:len(itr.itr.Key())-8], ts)
+		if len(itr.itr.Key()) > constant.MaxInlineKeySize+8 {
+			es, err := itr.m.group(itr.itr, itr.ts, itr.pref)
+			if err != nil {
+				return err
+			}
+			if len(es) > 0 {
+				sort.Slice(es, func(i, j int) bool { return bytes.Compare(es[i].k, es[j].k) > 0 })
+				itr.es = es
+				return nil
+			}
+			continue
 		}
-		if err := itr.itr.Next(); err != nil {
+		e, err := itr.m.next(itr.itr, itr.ts)
+		if err != nil {
 			return err
 		}
-	}
-	return errmsg.ScanEnd
-}
-
-func (itr *backwardIterator) filter(k []byte, ts uint64) error {
-	if !itr.itr.Valid() {
-		return errmsg.ScanEnd
-	}
-	itr.e.k = k
-	itr.e.ts = ts
-	itr.e.v = itr.itr.Value()
-	for {
-		if err := itr.itr.Next(); err != nil {
-			return err
-		}
-		if !itr.itr.Valid() {
-			return nil
-		}
-		if bytes.Compare(k, itr.itr.Key()[:len(itr.itr.Key())-8]) != 0 {
+		if e != nil && itr.pref == nil && !itr.m.erased(e.k, e.ts, itr.ts) {
+			itr.es = []*entry{e}
 			return nil
 		}
 	}
+	return errmsg.ScanEnd
 }
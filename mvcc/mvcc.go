@@ -1,66 +1,156 @@
 package mvcc
 
 import (
+	"bytes"
 	"encoding/binary"
+	"hash/fnv"
+	"sort"
 
 	"github.com/infinivision/gaeadb/constant"
+	"github.com/infinivision/gaeadb/data"
 	"github.com/infinivision/gaeadb/errmsg"
 	"github.com/infinivision/gaeadb/prefix"
 	"github.com/infinivision/gaeadb/suffix"
 )
 
-func New(t prefix.Tree) *mvcc {
-	return &mvcc{t}
+// New creates the mvcc of the tree t, the range deletions are kept in the file name.
+func New(t prefix.Tree, d data.Data, name string) (*mvcc, error) {
+	m := &mvcc{t: t, d: d}
+	if err := m.load(name); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
 func (m *mvcc) Close() error {
+	m.fp.Close()
 	return m.t.Close()
 }
 
+// Exist reports whether the version ts of k is stored,
+// the tail of a long key must be readable as well.
 func (m *mvcc) Exist(k []byte, ts uint64) bool {
-	buf := make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, ts)
-	_, err := m.t.Get(append(k, buf...))
+	o, err := m.t.Get(key(k, ts))
+	switch {
+	case err != nil:
+		return false
+	case len(k) <= constant.MaxInlineKeySize:
+		return true
+	}
+	_, err = m.long(k, o)
 	return err == nil
 }
 
 func (m *mvcc) Get(k []byte, ts uint64) (uint64, uint64, error) {
-	itr, err := m.t.NewBackwardIterator(k)
-	if err != nil {
+	var v, rts uint64
+
+	err := m.Versions(k, ts, func(x, xts uint64) bool {
+		v, rts = x, xts
+		return false
+	})
+	switch {
+	case err != nil:
 		return 0, 0, err
+	case rts == 0:
+		return 0, 0, errmsg.NotExist
+	}
+	return v, rts, nil
+}
+
+// Versions calls f with the value and the timestamp of each version of k
+// not newer than ts, from the newest one until f returns false. A range
+// deletion of k is reported as a version holding constant.Delete.
+func (m *mvcc) Versions(k []byte, ts uint64, f func(uint64, uint64) bool) error {
+	return m.versions(k, ts, f, nil)
+}
+
+// GetMany is Get of each key of ks, the timestamp of a key which does not exist
+// is zero. The keys are looked up in order sharing the descents of common prefixes.
+func (m *mvcc) GetMany(ks [][]byte, ts uint64) ([]uint64, []uint64, error) {
+	is := make([]int, len(ks))
+	for i, _ := range is {
+		is[i] = i
+	}
+	sort.Slice(is, func(i, j int) bool { return bytes.Compare(ks[is[i]], ks[is[j]]) < 0 })
+	p := new(prefix.Path)
+	vs, rs := make([]uint64, len(ks)), make([]uint64, len(ks))
+	for _, i := range is {
+		err := m.versions(ks[i], ts, func(v, rts uint64) bool {
+			vs[i], rs[i] = v, rts
+			return false
+		}, p)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return vs, rs, nil
+}
+
+func (m *mvcc) versions(k []byte, ts uint64, f func(uint64, uint64) bool, p *prefix.Path) error {
+	dts := m.deleted(k, ts)
+	pref := key(k, 0)
+	pref = pref[:len(pref)-8]
+	itr, err := m.t.NewBackwardIteratorFrom(pref, p)
+	if err != nil {
+		return err
 	}
 	defer itr.Close()
 	for itr.Valid() {
-		if len(itr.Key()) == len(k)+8 {
-			if v, rts := itr.Value(), binary.BigEndian.Uint64(itr.Key()[len(k):]); rts <= ts && v != constant.Cancel {
-				return v, rts, nil
+		if len(itr.Key()) == len(pref)+8 {
+			v, rts := itr.Value(), binary.BigEndian.Uint64(itr.Key()[len(pref):])
+			if long := rts&Long != 0; long == (len(k) > constant.MaxInlineKeySize) && rts&^Long <= ts && v != constant.Cancel {
+				if rts&^Long < dts {
+					f(constant.Delete, dts)
+					return nil
+				}
+				if !long {
+					if !f(v, rts) {
+						return nil
+					}
+				} else if v, err := m.long(k, v); err == nil { // a different key with the same hash is skipped
+					if !f(v, rts&^Long) {
+						return nil
+					}
+				}
 			}
 		}
 		if err := itr.Next(); err != nil {
-			return 0, 0, err
+			return err
 		}
 	}
-	return 0, 0, errmsg.NotExist
+	return nil
 }
 
 func (m *mvcc) Del(k []byte, ts uint64, w suffix.Writer) error {
-	buf := make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, ts)
-	return m.t.Del(append(k, buf...), w)
+	return m.t.Del(key(k, ts), w)
 }
 
 func (m *mvcc) Set(k []byte, v uint64, ts uint64, w suffix.Writer) error {
-	buf := make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, ts)
-	return m.t.Set(append(k, buf...), v, w)
+	if len(k) > constant.MaxInlineKeySize && v != constant.Cancel {
+		buf := make([]byte, 8+len(k)-constant.MaxInlineKeySize)
+		binary.LittleEndian.PutUint64(buf, v)
+		copy(buf[8:], k[constant.MaxInlineKeySize:])
+		o, err := m.d.Alloc(buf)
+		if err != nil {
+			return err
+		}
+		if err := m.d.Write(o, buf); err != nil {
+			return err
+		}
+		v = o
+	}
+	return m.t.Set(key(k, ts), v, w)
 }
 
 func (m *mvcc) NewForwardIterator(pref []byte, ts uint64) (Iterator, error) {
-	fItr, err := m.t.NewForwardIterator(pref)
+	fItr, err := m.t.NewForwardIterator(head(pref))
 	if err != nil {
 		return nil, err
 	}
-	itr := &forwardIterator{ts: ts, itr: fItr, e: new(entry)}
+	itr := &forwardIterator{m: m, ts: ts, itr: fItr}
+	if len(pref) > constant.MaxInlineKeySize {
+		itr.pref = pref
+	}
 	if err := itr.seek(); err != nil {
 		itr.Close()
 		return nil, err
@@ -69,14 +159,119 @@ func (m *mvcc) NewForwardIterator(pref []byte, ts uint64) (Iterator, error) {
 }
 
 func (m *mvcc) NewBackwardIterator(pref []byte, ts uint64) (Iterator, error) {
-	bItr, err := m.t.NewBackwardIterator(pref)
+	bItr, err := m.t.NewBackwardIterator(head(pref))
 	if err != nil {
 		return nil, err
 	}
-	itr := &backwardIterator{ts: ts, itr: bItr, e: new(entry)}
+	itr := &backwardIterator{m: m, ts: ts, itr: bItr}
+	if len(pref) > constant.MaxInlineKeySize {
+		itr.pref = pref
+	}
 	if err := itr.seek(); err != nil {
 		itr.Close()
 		return nil, err
 	}
 	return itr, nil
 }
+
+// Fanout returns the bytes following pref in the index, the bytes of the
+// timestamps of pref itself are included. It is nil if the keys with prefix
+// pref lie in a suffix node or pref reaches the hashed tails of long keys.
+func (m *mvcc) Fanout(pref []byte) ([]byte, error) {
+	if len(pref) >= constant.MaxInlineKeySize {
+		return nil, nil
+	}
+	return m.t.Fanout(pref)
+}
+
+// long returns the value of the long key k stored at o, the stored tail must match k.
+func (m *mvcc) long(k []byte, o uint64) (uint64, error) {
+	tail, v, err := m.tail(o)
+	switch {
+	case err != nil:
+		return 0, err
+	case !bytes.Equal(tail, k[constant.MaxInlineKeySize:]):
+		return 0, errmsg.NotExist
+	}
+	return v, nil
+}
+
+// tail returns the tail of a long key and its value stored at o.
+func (m *mvcc) tail(o uint64) ([]byte, uint64, error) {
+	buf, err := m.d.Read(o)
+	switch {
+	case err != nil:
+		return nil, 0, err
+	case len(buf) < 8:
+		return nil, 0, errmsg.ReadFailed
+	}
+	return buf[8:], binary.LittleEndian.Uint64(buf), nil
+}
+
+// next consumes every version of the current key of itr and returns
+// the latest version visible at ts, nil means no version is visible.
+func (m *mvcc) next(itr prefix.Iterator, ts uint64) (*entry, error) {
+	var e *entry
+
+	k := append([]byte{}, itr.Key()[:len(itr.Key())-8]...)
+	for itr.Valid() && len(itr.Key()) == len(k)+8 && bytes.HasPrefix(itr.Key(), k) {
+		rts := binary.BigEndian.Uint64(itr.Key()[len(k):])
+		if v := itr.Value(); rts&^Long <= ts && v != constant.Cancel && (e == nil || rts > e.ts) {
+			e = &entry{k: k, v: v, ts: rts}
+		}
+		if err := itr.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// group returns the visible keys longer than constant.MaxInlineKeySize whose head
+// is the head of the current key of itr, their order in the tree is not the key order.
+func (m *mvcc) group(itr prefix.Iterator, ts uint64, pref []byte) ([]*entry, error) {
+	var es []*entry
+
+	h := append([]byte{}, itr.Key()[:constant.MaxInlineKeySize]...)
+	for itr.Valid() && len(itr.Key()) > constant.MaxInlineKeySize+8 && bytes.HasPrefix(itr.Key(), h) {
+		e, err := m.next(itr, ts)
+		switch {
+		case err != nil:
+			return nil, err
+		case e == nil:
+			continue
+		case e.ts&Long != 0:
+			tail, v, err := m.tail(e.v)
+			if err != nil {
+				return nil, err
+			}
+			e.k = append(append([]byte{}, h...), tail...)
+			e.v, e.ts = v, e.ts&^Long
+		}
+		if bytes.HasPrefix(e.k, pref) && !m.erased(e.k, e.ts, ts) {
+			es = append(es, e)
+		}
+	}
+	return es, nil
+}
+
+// key returns the key of version ts of k in the tree
+func key(k []byte, ts uint64) []byte {
+	buf := make([]byte, 8)
+	if len(k) <= constant.MaxInlineKeySize {
+		binary.BigEndian.PutUint64(buf, ts)
+		return append(append([]byte{}, k...), buf...)
+	}
+	h := fnv.New64a()
+	h.Write(k[constant.MaxInlineKeySize:])
+	binary.BigEndian.PutUint64(buf, ts|Long)
+	return append(h.Sum(append([]byte{}, k[:constant.MaxInlineKeySize]...)), buf...)
+}
+
+// head returns the part of pref kept in the tree, its capacity is capped
+// since the tree appends to a prefix and pref must stay intact.
+func head(pref []byte) []byte {
+	if len(pref) > constant.MaxInlineKeySize {
+		return pref[:constant.MaxInlineKeySize:constant.MaxInlineKeySize]
+	}
+	return pref[:len(pref):len(pref)]
+}
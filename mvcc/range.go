@@ -0,0 +1,242 @@
+package mvcc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// DelRange deletes the keys from start up to end as of ts, a nil end is unbounded.
+// The deletion is kept in a file synchronously, deleting the same range at the
+// same timestamp again is ignored.
+func (m *mvcc) DelRange(start, end []byte, ts uint64) error {
+	if len(end) == 0 {
+		end = nil
+	}
+	start, end = copyBytes(start), copyBytes(end)
+	m.Lock()
+	defer m.Unlock()
+	if ts <= m.sts { // settled already
+		return nil
+	}
+	for _, d := range m.rs {
+		if d.ts == ts && bytes.Equal(d.start, start) && bytes.Equal(d.end, end) {
+			return nil
+		}
+	}
+	d := &tomb{ts, start, end}
+	if _, err := m.fp.Write(d.encode(nil)); err != nil {
+		return err
+	}
+	if err := m.fp.Sync(); err != nil {
+		return err
+	}
+	m.n++
+	m.rs = append(m.rs, d)
+	return nil
+}
+
+// Prune settles the range deletions not newer than ts, the read timestamp of the oldest
+// live snapshot. A settled deletion is cut into the disjoint ranges kept by start where
+// it is the latest one, those covered by later deletions are dropped. The file is
+// rewritten once it holds twice the deletions kept.
+func (m *mvcc) Prune(ts uint64) error {
+	m.Lock()
+	defer m.Unlock()
+	if ts <= m.sts {
+		return nil
+	}
+	m.settleTo(ts)
+	if n := len(m.ds) + len(m.rs); m.n == 0 || m.n < 2*n {
+		return nil
+	}
+	return m.rewrite()
+}
+
+// Settled returns the timestamp up to which the range deletions are settled,
+// a snapshot below it may miss a deletion covered by a later one.
+func (m *mvcc) Settled() uint64 {
+	m.RLock()
+	defer m.RUnlock()
+	return m.sts
+}
+
+// deleted returns the timestamp of the latest range deletion of k not newer than ts.
+func (m *mvcc) deleted(k []byte, ts uint64) uint64 {
+	var dts uint64
+
+	m.RLock()
+	defer m.RUnlock()
+	if i := sort.Search(len(m.ds), func(i int) bool { return bytes.Compare(m.ds[i].start, k) > 0 }); i > 0 {
+		if d := m.ds[i-1]; d.ts <= ts && d.contains(k) {
+			dts = d.ts
+		}
+	}
+	for _, d := range m.rs {
+		if d.ts <= ts && d.ts > dts && d.contains(k) {
+			dts = d.ts
+		}
+	}
+	return dts
+}
+
+// erased reports whether the version vts of k is deleted by a range deletion visible at ts.
+func (m *mvcc) erased(k []byte, vts, ts uint64) bool {
+	return m.deleted(k, ts) > vts
+}
+
+// load reads the range deletions, an incomplete one at the end is discarded.
+func (m *mvcc) load(name string) error {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	o := 0
+	for len(buf[o:]) >= 10 {
+		ts := binary.LittleEndian.Uint64(buf[o:])
+		n := int(binary.LittleEndian.Uint16(buf[o+8:]))
+		if len(buf[o+10:]) < n+2 {
+			break
+		}
+		start := buf[o+10 : o+10+n]
+		x := o + 10 + n
+		n = int(binary.LittleEndian.Uint16(buf[x:]))
+		if len(buf[x+2:]) < n {
+			break
+		}
+		end := buf[x+2 : x+2+n]
+		if n == 0 {
+			end = nil
+		}
+		if len(start) == 0 {
+			start = nil
+		}
+		switch {
+		case ts&Long != 0: // settled timestamp
+			m.sts = ts &^ Long
+		default:
+			m.rs = append(m.rs, &tomb{ts, start, end})
+		}
+		o = x + 2 + n
+	}
+	m.n, m.name = len(m.rs), name
+	m.settleTo(m.sts)
+	if m.fp, err = os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0664); err != nil {
+		return err
+	}
+	if err := m.fp.Truncate(int64(o)); err != nil {
+		m.fp.Close()
+		return err
+	}
+	if _, err := m.fp.Seek(int64(o), 0); err != nil {
+		m.fp.Close()
+		return err
+	}
+	return nil
+}
+
+// rewrite replaces the file by the settled timestamp marked by Long and the range
+// deletions kept, the old file stays in place until the new one is complete.
+func (m *mvcc) rewrite() error {
+	buf := (&tomb{ts: m.sts | Long}).encode(nil)
+	for _, d := range m.ds {
+		buf = d.encode(buf)
+	}
+	for _, d := range m.rs {
+		buf = d.encode(buf)
+	}
+	fp, err := os.OpenFile(m.name+".tmp", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0664)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(buf); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := os.Rename(m.name+".tmp", m.name); err != nil {
+		fp.Close()
+		return err
+	}
+	m.fp.Close()
+	m.fp, m.n = fp, len(m.ds)+len(m.rs)
+	return nil
+}
+
+// settleTo settles the range deletions not newer than ts
+func (m *mvcc) settleTo(ts uint64) {
+	sort.Slice(m.rs, func(i, j int) bool { return m.rs[i].ts < m.rs[j].ts })
+	i := sort.Search(len(m.rs), func(i int) bool { return m.rs[i].ts > ts })
+	for _, d := range m.rs[:i] {
+		m.ds = settle(m.ds, d)
+	}
+	m.rs, m.sts = m.rs[i:], ts
+}
+
+// settle cuts d into the sorted disjoint ranges ds, a range keeps the latest deletion of its keys.
+func settle(ds []*tomb, d *tomb) []*tomb {
+	var xs []*tomb
+	var tail *tomb
+
+	i := sort.Search(len(ds), func(i int) bool { return after(ds[i].end, d.start) })
+	j := i
+	for ; j < len(ds) && (d.end == nil || bytes.Compare(ds[j].start, d.end) < 0); j++ {
+	}
+	c, done := d.start, false // the part of d before c is placed
+	for _, x := range ds[i:j] {
+		if x.ts >= d.ts {
+			if bytes.Compare(c, x.start) < 0 {
+				xs = append(xs, &tomb{d.ts, c, x.start})
+			}
+			xs = append(xs, x)
+			if c = x.end; c == nil {
+				done = true
+			}
+			continue
+		}
+		if bytes.Compare(x.start, d.start) < 0 {
+			xs = append(xs, &tomb{x.ts, x.start, d.start})
+		}
+		if d.end != nil && after(x.end, d.end) {
+			tail = &tomb{x.ts, d.end, x.end}
+		}
+	}
+	if !done && (d.end == nil || bytes.Compare(c, d.end) < 0) {
+		xs = append(xs, &tomb{d.ts, c, d.end})
+	}
+	if tail != nil {
+		xs = append(xs, tail)
+	}
+	return append(append(append([]*tomb{}, ds[:i]...), xs...), ds[j:]...)
+}
+
+// after reports whether the end bound e is beyond k, a nil end is unbounded.
+func after(e, k []byte) bool {
+	return e == nil || bytes.Compare(e, k) > 0
+}
+
+func (d *tomb) contains(k []byte) bool {
+	return bytes.Compare(k, d.start) >= 0 && (d.end == nil || bytes.Compare(k, d.end) < 0)
+}
+
+// encode appends the record of d to buf
+func (d *tomb) encode(buf []byte) []byte {
+	buf = append(buf, make([]byte, 10)...)
+	binary.LittleEndian.PutUint64(buf[len(buf)-10:], d.ts)
+	binary.LittleEndian.PutUint16(buf[len(buf)-2:], uint16(len(d.start)))
+	buf = append(buf, d.start...)
+	buf = append(buf, byte(len(d.end)), byte(len(d.end)>>8))
+	return append(buf, d.end...)
+}
+
+func copyBytes(x []byte) []byte {
+	if len(x) == 0 {
+		return nil
+	}
+	return append([]byte{}, x...)
+}
@@ -0,0 +1,254 @@
+package mvcc
+
+import (
+	"sync/atomic"
+
+	"github.com/infinivision/gaeadb/data"
+	"github.com/infinivision/gaeadb/errmsg"
+	"github.com/infinivision/gaeadb/suffix"
+)
+
+// NewSpace creates the mvcc of the namespaces ns, ms[i] keeps the keys of ns[i] whose tag is i.
+func NewSpace(ms []MVCC, ns []Namespace) *space {
+	return &space{ms: ms, ns: ns}
+}
+
+func (s *space) Close() error {
+	for _, m := range s.ms {
+		m.Close()
+	}
+	return nil
+}
+
+func (s *space) Namespace(name string) (Namespace, error) {
+	for _, n := range s.ns {
+		if n.Name == name {
+			return n, nil
+		}
+	}
+	return Namespace{}, errmsg.UnknownNamespace
+}
+
+func (s *space) Namespaces() []Namespace {
+	return s.ns
+}
+
+func (s *space) Exist(k []byte, ts uint64) bool {
+	m, k, err := s.route(k)
+	if err != nil {
+		return false
+	}
+	return m.Exist(k, ts)
+}
+
+func (s *space) Del(k []byte, ts uint64, w suffix.Writer) error {
+	m, k, err := s.route(k)
+	if err != nil {
+		return err
+	}
+	return m.Del(k, ts, w)
+}
+
+func (s *space) Get(k []byte, ts uint64) (uint64, uint64, error) {
+	m, k, err := s.route(k)
+	if err != nil {
+		return 0, 0, err
+	}
+	return m.Get(k, ts)
+}
+
+// GetMany looks up the keys of each namespace together.
+func (s *space) GetMany(ks [][]byte, ts uint64) ([]uint64, []uint64, error) {
+	mp := make(map[byte][]int)
+	for i, k := range ks {
+		if _, _, err := s.route(k); err != nil {
+			return nil, nil, err
+		}
+		mp[k[0]] = append(mp[k[0]], i)
+	}
+	vs, rs := make([]uint64, len(ks)), make([]uint64, len(ks))
+	for tag, is := range mp {
+		xs := make([][]byte, len(is))
+		for j, i := range is {
+			xs[j] = ks[i][1:]
+		}
+		os, ts, err := s.ms[tag].GetMany(xs, ts)
+		if err != nil {
+			return nil, nil, err
+		}
+		for j, i := range is {
+			vs[i], rs[i] = os[j], ts[j]
+		}
+	}
+	return vs, rs, nil
+}
+
+func (s *space) Versions(k []byte, ts uint64, f func(uint64, uint64) bool) error {
+	m, k, err := s.route(k)
+	if err != nil {
+		return err
+	}
+	return m.Versions(k, ts, f)
+}
+
+func (s *space) Set(k []byte, v uint64, ts uint64, w suffix.Writer) error {
+	m, k, err := s.route(k)
+	if err != nil {
+		return err
+	}
+	for x := atomic.LoadUint64(&s.ets); v&data.ExpireMark != 0 && ts > x; x = atomic.LoadUint64(&s.ets) {
+		if atomic.CompareAndSwapUint64(&s.ets, x, ts) {
+			break
+		}
+	}
+	return m.Set(k, v, ts, w)
+}
+
+// Expiring returns the latest timestamp of an expiring value written since the space is opened.
+func (s *space) Expiring() uint64 {
+	return atomic.LoadUint64(&s.ets)
+}
+
+// DelRange deletes the keys of the namespace of start, an end beyond the namespace is unbounded.
+func (s *space) DelRange(start, end []byte, ts uint64) error {
+	m, x, err := s.route(start)
+	if err != nil {
+		return err
+	}
+	if len(end) > 0 && end[0] == start[0] {
+		return m.DelRange(x, end[1:], ts)
+	}
+	return m.DelRange(x, nil, ts)
+}
+
+func (s *space) Prune(ts uint64) error {
+	for _, m := range s.ms {
+		if err := m.Prune(ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Settled returns the latest timestamp up to which the range deletions of a namespace are settled.
+func (s *space) Settled() uint64 {
+	var ts uint64
+
+	for _, m := range s.ms {
+		if x := m.Settled(); x > ts {
+			ts = x
+		}
+	}
+	return ts
+}
+
+func (s *space) Fanout(pref []byte) ([]byte, error) {
+	m, pref, err := s.route(pref)
+	if err != nil {
+		return nil, err
+	}
+	return m.Fanout(pref)
+}
+
+// NewForwardIterator iterates the namespace of pref, or every namespace in order if pref is empty.
+func (s *space) NewForwardIterator(pref []byte, ts uint64) (Iterator, error) {
+	return s.newIterator(pref, ts, false)
+}
+
+func (s *space) NewBackwardIterator(pref []byte, ts uint64) (Iterator, error) {
+	return s.newIterator(pref, ts, true)
+}
+
+func (s *space) newIterator(pref []byte, ts uint64, rev bool) (Iterator, error) {
+	itr := &spaceIterator{ts: ts, rev: rev, s: s}
+	switch {
+	case len(pref) > 0:
+		if _, _, err := s.route(pref); err != nil {
+			return nil, err
+		}
+		itr.tags, itr.pref = []byte{pref[0]}, pref[1:]
+	default:
+		for i, _ := range s.ms {
+			itr.tags = append(itr.tags, byte(i))
+		}
+		if rev {
+			for i, j := 0, len(itr.tags)-1; i < j; i, j = i+1, j-1 {
+				itr.tags[i], itr.tags[j] = itr.tags[j], itr.tags[i]
+			}
+		}
+	}
+	if err := itr.seek(); err != nil {
+		itr.Close()
+		return nil, err
+	}
+	return itr, nil
+}
+
+// route returns the mvcc of the namespace of k and k without its tag
+func (s *space) route(k []byte) (MVCC, []byte, error) {
+	if len(k) == 0 || int(k[0]) >= len(s.ms) {
+		return nil, nil, errmsg.UnknownNamespace
+	}
+	return s.ms[k[0]], k[1:], nil
+}
+
+func (itr *spaceIterator) Close() error {
+	if itr.itr == nil {
+		return nil
+	}
+	return itr.itr.Close()
+}
+
+func (itr *spaceIterator) Next() error {
+	if err := itr.itr.Next(); err != nil && err != errmsg.ScanEnd {
+		return err
+	}
+	return itr.seek()
+}
+
+func (itr *spaceIterator) Valid() bool {
+	return itr.itr != nil && itr.itr.Valid()
+}
+
+func (itr *spaceIterator) Key() []byte {
+	return itr.k
+}
+
+func (itr *spaceIterator) Value() uint64 {
+	return itr.itr.Value()
+}
+
+func (itr *spaceIterator) Timestamp() uint64 {
+	return itr.itr.Timestamp()
+}
+
+// seek moves to the next namespace until a key is found
+func (itr *spaceIterator) seek() error {
+	var err error
+
+	for !itr.Valid() {
+		if itr.itr != nil {
+			itr.itr.Close()
+			itr.itr = nil
+		}
+		if len(itr.tags) == 0 {
+			return errmsg.ScanEnd
+		}
+		m := itr.s.ms[itr.tags[0]]
+		if itr.rev {
+			itr.itr, err = m.NewBackwardIterator(itr.pref, itr.ts)
+		} else {
+			itr.itr, err = m.NewForwardIterator(itr.pref, itr.ts)
+		}
+		switch {
+		case err == errmsg.ScanEnd:
+			itr.itr = nil
+		case err != nil:
+			itr.itr = nil
+			return err
+		}
+		itr.tag, itr.tags = itr.tags[0], itr.tags[1:]
+	}
+	itr.k = append([]byte{itr.tag}, itr.itr.Key()...)
+	return nil
+}
@@ -1,22 +1,55 @@
 package mvcc
 
 import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/infinivision/gaeadb/data"
 	"github.com/infinivision/gaeadb/prefix"
 	"github.com/infinivision/gaeadb/suffix"
 )
 
+// Long marks the timestamp of a key longer than constant.MaxInlineKeySize,
+// such a key is stored in the tree as its head and the hash of its tail,
+// the tail is stored in the data file together with the value.
+const Long = uint64(1) << 63
+
 type MVCC interface {
 	Close() error
 
 	Exist([]byte, uint64) bool
 	Del([]byte, uint64, suffix.Writer) error
 	Get([]byte, uint64) (uint64, uint64, error)
+	GetMany([][]byte, uint64) ([]uint64, []uint64, error)
+	Versions([]byte, uint64, func(uint64, uint64) bool) error
 	Set([]byte, uint64, uint64, suffix.Writer) error
+	DelRange([]byte, []byte, uint64) error
+	Prune(uint64) error
+	Settled() uint64
+	Fanout([]byte) ([]byte, error)
 
 	NewForwardIterator([]byte, uint64) (Iterator, error)
 	NewBackwardIterator([]byte, uint64) (Iterator, error)
 }
 
+// Space is the mvcc of the namespaces, a key is tagged by the first byte
+// which is the tag of its namespace, the default namespace is tagged by zero.
+type Space interface {
+	MVCC
+
+	Namespace(string) (Namespace, error)
+	Namespaces() []Namespace // indexed by tag
+	Expiring() uint64        // latest timestamp of an expiring value written since opened
+}
+
+// Namespace is a keyspace kept by its own tree.
+type Namespace struct {
+	Tag  byte
+	Name string        // empty for the default namespace
+	TTL  time.Duration // values set without a ttl expire after TTL unless it is zero
+}
+
 type Iterator interface {
 	Close() error
 	Next() error
@@ -33,19 +66,54 @@ type entry struct {
 }
 
 type forwardIterator struct {
-	s   bool
-	e   *entry
-	ts  uint64
-	itr prefix.Iterator
+	ts   uint64
+	pref []byte   // prefix longer than constant.MaxInlineKeySize
+	es   []*entry // keys sharing the head are sorted before returned
+	m    *mvcc
+	itr  prefix.Iterator
 }
 
 type backwardIterator struct {
-	s   bool
-	e   *entry
-	ts  uint64
-	itr prefix.Iterator
+	ts   uint64
+	pref []byte   // prefix longer than constant.MaxInlineKeySize
+	es   []*entry // keys sharing the head are sorted before returned
+	m    *mvcc
+	itr  prefix.Iterator
+}
+
+// spaceIterator iterates the namespaces of tags in order, its keys are tagged
+type spaceIterator struct {
+	k    []byte
+	tag  byte
+	ts   uint64
+	rev  bool
+	pref []byte // untagged
+	tags []byte // namespaces left
+	s    *space
+	itr  Iterator
+}
+
+type space struct {
+	ets uint64 // latest timestamp of an expiring value, first to be aligned for atomic access
+	ms  []MVCC
+	ns  []Namespace
+}
+
+// tomb deletes the keys from start up to end as of ts, a nil end is unbounded
+type tomb struct {
+	ts    uint64
+	start []byte
+	end   []byte
 }
 
 type mvcc struct {
-	t prefix.Tree
+	sync.RWMutex
+	n    int    // range deletions in the file
+	sts  uint64 // range deletions up to it are settled
+	name string
+	t    prefix.Tree
+	d    data.Data
+	fp   *os.File // range deletions
+	ds   []*tomb  // settled, disjoint and sorted by start
+	rs   []*tomb  // not settled
 }
@@ -23,7 +23,6 @@ func (itr *backwardIterator) Close() error {
 			itr.t.c.Release(e.rsrc.pg)
 		}
 	}
-	return nil
 }
 
 func (itr *backwardIterator) Next() error {
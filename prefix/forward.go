@@ -24,7 +24,6 @@ func (itr *forwardIterator) Close() error {
 			itr.t.c.Release(e.rsrc.pg)
 		}
 	}
-	return nil
 }
 
 func (itr *forwardIterator) Next() error {
@@ -42,7 +42,7 @@ func (t *tree) Get(k []byte) (uint64, error) {
 			return v, nil
 		}
 	case constant.ES:
-		return 0, nil
+		return 0, errmsg.NotExist
 	case constant.MS:
 		return t.find(k, pn)
 	case constant.SN:
@@ -100,6 +100,12 @@ func (t *tree) NewForwardIterator(pref []byte) (Iterator, error) {
 }
 
 func (t *tree) NewBackwardIterator(pref []byte) (Iterator, error) {
+	return t.NewBackwardIteratorFrom(pref, nil)
+}
+
+// NewBackwardIteratorFrom descends to pref from the nodes remembered by p,
+// and remembers the nodes passed in p. p may be nil.
+func (t *tree) NewBackwardIteratorFrom(pref []byte, p *Path) (Iterator, error) {
 	s := stack.New()
 	switch {
 	case len(pref) == 0:
@@ -109,7 +115,7 @@ func (t *tree) NewBackwardIterator(pref []byte) (Iterator, error) {
 			pref: pref,
 		})
 	default:
-		typ, pn, le, suff, pg, err := t.down(pref, false)
+		typ, pn, le, suff, pg, err := t.walk(pref, false, p)
 		if err != nil {
 			return nil, err
 		}
@@ -125,6 +131,92 @@ func (t *tree) NewBackwardIterator(pref []byte) (Iterator, error) {
 	return itr, nil
 }
 
+// Fanout returns the bytes following pref which lead to entries when the node of pref
+// is a prefix node, it returns nil if the entries with prefix pref lie in a suffix node.
+func (t *tree) Fanout(pref []byte) ([]byte, error) {
+	pn := constant.RootPage
+	if len(pref) > 0 {
+		typ, _, le, k, pg, err := t.down(pref, false)
+		if err != nil {
+			return nil, err
+		}
+		defer t.c.Release(pg)
+		defer le.RUnlock()
+		if typ != constant.PN {
+			return nil, nil
+		}
+		if pn, typ = branch(k[0], pg.Buffer()); typ != constant.PN {
+			return nil, nil
+		}
+	}
+	pg, err := t.c.Get(pn)
+	if err != nil {
+		return nil, err
+	}
+	defer t.c.Release(pg)
+	var bs []byte
+	mp := make(map[int64][]bool) // first bytes of the mixed suffix nodes
+	for i := 0; i < 256; i++ {
+		ok, err := t.fork(pn, pg, byte(i), mp)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			bs = append(bs, byte(i))
+		}
+	}
+	return bs, nil
+}
+
+// fork reports whether the branch i of the prefix node pn leads to entries,
+// a preallocated prefix node may be empty and a mixed suffix node may hold
+// no entries of the branch.
+func (t *tree) fork(pn int64, pg cache.Page, i byte, mp map[int64][]bool) (bool, error) {
+	le := t.t.Get(uint64(pn) | uint64(i)<<constant.TypeOff)
+	le.RLock()
+	defer le.RUnlock()
+	if binary.LittleEndian.Uint64(pg.Buffer()[2048+int(i)*8:]) != constant.Cancel {
+		return true, nil
+	}
+	switch cn, typ := branch(i, pg.Buffer()); {
+	case typ == constant.ES:
+		return false, nil
+	case typ == constant.MS: // the node is shared by a range of branches
+		if _, ok := mp[cn]; !ok {
+			cpg, err := t.c.Get(cn)
+			if err != nil {
+				return false, err
+			}
+			mp[cn] = make([]bool, 256)
+			for itr := suffix.NewForwardIterator(nil, nil, nil, cpg); itr.Valid(); itr.Next() {
+				if k := itr.Key(); len(k) > 0 {
+					mp[cn][k[0]] = true
+				}
+			}
+			t.c.Release(cpg)
+		}
+		return mp[cn][i], nil
+	case typ == constant.PN && cn < constant.Preallocate:
+		cpg, err := t.c.Get(cn)
+		if err != nil {
+			return false, err
+		}
+		defer t.c.Release(cpg)
+		for j := 0; j < 256; j++ {
+			le := t.t.Get(uint64(cn) | uint64(j)<<constant.TypeOff)
+			le.RLock()
+			_, typ := branch(byte(j), cpg.Buffer())
+			v := binary.LittleEndian.Uint64(cpg.Buffer()[2048+j*8:])
+			le.RUnlock()
+			if typ != constant.ES || v != constant.Cancel {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
 func (t *tree) newForwardElement(s stack.Stack, typ int, pn int64, rsrc *resource, pref, suff []byte) error {
 	for {
 		switch typ {
@@ -225,7 +317,6 @@ func (t *tree) newForwardElement(s stack.Stack, typ int, pn int64, rsrc *resourc
 			}
 		}
 	}
-	return errmsg.UnknownError
 }
 
 func (t *tree) newBackwardElement(s stack.Stack, typ int, pn int64, rsrc *resource, pref, suff []byte) error {
@@ -328,7 +419,6 @@ func (t *tree) newBackwardElement(s stack.Stack, typ int, pn int64, rsrc *resour
 			}
 		}
 	}
-	return errmsg.UnknownError
 }
 
 // return value
@@ -338,7 +428,15 @@ func (t *tree) newBackwardElement(s stack.Stack, typ int, pn int64, rsrc *resour
 //  k   - suffix
 //  pg  - parent node
 func (t *tree) down(k []byte, update bool) (int, int64, locker.Locker, []byte, cache.Page, error) {
+	return t.walk(k, update, nil)
+}
+
+// walk is down starting from the deepest node of p shared with k
+func (t *tree) walk(k []byte, update bool, p *Path) (int, int64, locker.Locker, []byte, cache.Page, error) {
 	pn, typ := constant.RootPage, constant.PN
+	if p != nil {
+		pn, k = p.start(k)
+	}
 	le := t.t.Get(uint64(pn) | uint64(k[0])<<constant.TypeOff)
 	switch {
 	case update:
@@ -354,9 +452,13 @@ func (t *tree) down(k []byte, update bool) (int, int64, locker.Locker, []byte, c
 		if len(k) == 1 {
 			return typ, pn, le, k, pg, nil
 		}
+		par := pn
 		pn, typ = branch(k[0], pg.Buffer())
 		switch typ {
 		case constant.PN:
+			if p != nil {
+				p.ps = append(p.ps, par)
+			}
 			k = k[1:]
 			if len(k) > 1 {
 				if ok, rtyp, rpn, rpg, err := t.detect(k, pn); err != nil {
@@ -404,7 +506,10 @@ func (t *tree) find(k []byte, pn int64) (uint64, error) {
 		return 0, err
 	}
 	defer t.c.Release(pg)
-	return suffix.Find(k, pg.Buffer()), nil
+	if v := suffix.Find(k, pg.Buffer()); v != constant.Cancel {
+		return v, nil
+	}
+	return 0, errmsg.NotExist
 }
 
 func (t *tree) insert(k []byte, v uint64, w suffix.Writer, pn int64, par cache.Page) error {
@@ -476,6 +581,26 @@ func (t *tree) detect(k []byte, pn int64) (bool, int, int64, cache.Page, error)
 	return false, 0, 0, nil, nil
 }
 
+// start returns the deepest node of p shared with k and the rest of k,
+// p then remembers the nodes of k down to it.
+func (p *Path) start(k []byte) (int64, []byte) {
+	i := 0
+	for i < len(p.k) && i < len(k) && p.k[i] == k[i] {
+		i++
+	}
+	if i > len(p.ps) {
+		i = len(p.ps)
+	}
+	p.k = append(p.k[:0], k...)
+	if i == 0 {
+		p.ps = p.ps[:0]
+		return constant.RootPage, k
+	}
+	pn := p.ps[i-1]
+	p.ps = p.ps[:i-1]
+	return pn, k[i-1:]
+}
+
 func branch(k byte, buf []byte) (int64, int) {
 	pn := binary.LittleEndian.Uint64(buf[int(k)*8:])
 	return int64(pn & constant.Mask), int((pn >> constant.TypeOff) & constant.TypeMask)
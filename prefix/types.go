@@ -24,6 +24,9 @@ type Tree interface {
 
 	NewForwardIterator([]byte) (Iterator, error)
 	NewBackwardIterator([]byte) (Iterator, error)
+	NewBackwardIteratorFrom([]byte, *Path) (Iterator, error)
+
+	Fanout([]byte) ([]byte, error)
 }
 
 type Iterator interface {
@@ -35,6 +38,14 @@ type Iterator interface {
 	Value() uint64
 }
 
+// Path remembers the prefix nodes passed by a descent, a descent of a key
+// sharing a prefix with the last one starts from the deepest node shared.
+// A prefix node is never removed or replaced, so the nodes stay valid.
+type Path struct {
+	k  []byte
+	ps []int64 // ps[i] is the node of k[:i], its branch k[i] is a prefix node
+}
+
 type resource struct {
 	pg cache.Page
 	le locker.Locker
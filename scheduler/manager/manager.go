@@ -50,6 +50,14 @@ func (m *manager) Del(ts uint64) bool {
 	return false
 }
 
+// Min returns the smallest registered timestamp
+func (m *manager) Min() (uint64, bool) {
+	if len(m.xs) == 0 {
+		return 0, false
+	}
+	return m.xs[0].ts, true
+}
+
 func push(x *element, xs []*element) []*element {
 	i := sort.Search(len(xs), func(i int) bool { return xs[i].ts >= x.ts })
 	xs = append(xs, &element{})
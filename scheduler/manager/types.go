@@ -3,6 +3,7 @@ package manager
 type Manager interface {
 	Add(uint64)
 	Del(uint64) bool
+	Min() (uint64, bool)
 }
 
 type element struct {
@@ -3,6 +3,7 @@ package scheduler
 import (
 	"encoding/binary"
 	"sort"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -10,21 +11,34 @@ import (
 	"github.com/infinivision/gaeadb/constant"
 	"github.com/infinivision/gaeadb/data"
 	"github.com/infinivision/gaeadb/errmsg"
+	"github.com/infinivision/gaeadb/locker"
+	"github.com/infinivision/gaeadb/mvcc"
 	"github.com/infinivision/gaeadb/scheduler/manager"
 	"github.com/infinivision/gaeadb/wal"
+	"github.com/nnsgmsone/damrey/logger"
 )
 
-func New(ts uint64, d data.Data, c cache.Cache, w wal.Writer) *scheduler {
+// New creates the scheduler of the last commit timestamp ts,
+// the range deletions up to sts are settled.
+func New(ts, sts uint64, mng bool, d data.Data, cs []cache.Cache, w wal.Writer, lt locker.KeyTable, log logger.Log) *scheduler {
 	return &scheduler{
+		lt:  lt,
 		ts:  ts,
+		sts: sts,
+		vts: ts,
 		mts: ts,
+		mng: mng,
+		log: log,
 		xs:  []*element{},
+		amp: make(map[uint64]*active),
 		mgr: manager.New(),
 		ch:  make(chan struct{}),
+		dch: make(chan struct{}),
 		mp:  make(map[string]*element),
+		pmp: make(map[uint64]struct{}),
 		mch: make(chan *message, 1024),
 		cp: &checkpoint{
-			c:  c,
+			cs: cs,
 			d:  d,
 			w:  w,
 			s:  true,
@@ -53,59 +67,156 @@ func (s *scheduler) Run() {
 func (s *scheduler) Stop() {
 	s.ch <- struct{}{}
 	<-s.ch
+	close(s.dch)
 }
 
-func (s *scheduler) Start() uint64 {
-	ts := atomic.LoadUint64(&s.ts)
-	s.mch <- &message{t: S, ts: ts}
-	return ts
+// Start registers a transaction reading at the last applied commit timestamp,
+// it returns the id of the transaction and the read timestamp.
+func (s *scheduler) Start() (uint64, uint64) {
+	r := s.call(&message{t: S})
+	return r.id, r.ts
+}
+
+// StartAt registers a transaction reading at the timestamp supplied by the application,
+// it must not be newer than the last commit timestamp nor older than the settled range
+// deletions, a transaction reading below the oldest snapshot kept can not commit writes.
+func (s *scheduler) StartAt(ts uint64) (uint64, error) {
+	if !s.mng {
+		return 0, errmsg.UnmanagedTimestamp
+	}
+	r := s.call(&message{t: S, ts: ts, sup: true})
+	return r.id, r.err
+}
+
+// Resume registers a transaction reading at the snapshot of an earlier transaction
+// whether the timestamps are managed by the application or not, unless range deletions
+// newer than the snapshot are settled.
+func (s *scheduler) Resume(ts uint64) (uint64, error) {
+	r := s.call(&message{t: S, ts: ts, sup: true})
+	return r.id, r.err
+}
+
+// End releases the snapshot of a transaction which is rolled back,
+// errmsg.DatabaseClosed is returned once the scheduler is stopped.
+func (s *scheduler) End(id uint64) error {
+	return s.send(&message{t: E, id: id})
 }
 
 func (s *scheduler) Done(ts uint64) error {
-	rch := make(chan *result)
-	s.mch <- &message{t: D, ts: ts, rch: rch}
-	r := <-rch
-	return r.err
+	return s.call(&message{t: D, ts: ts}).err
 }
 
-func (s *scheduler) Commit(ts uint64, rmp map[string]uint64, wmp map[string][]byte) (uint64, error) {
-	rch := make(chan *result)
-	s.mch <- &message{C, ts, rch, rmp, wmp}
-	r := <-rch
+// Oldest returns the read timestamp of the oldest live snapshot, or of
+// the next transaction if none is running. No snapshot can start below
+// it afterwards since the range deletions up to it are settled.
+func (s *scheduler) Oldest() (uint64, error) {
+	r := s.call(&message{t: O})
 	return r.ts, r.err
 }
 
+// Commit validates the transaction and returns its commit timestamp,
+// wts is zero unless the timestamps are managed by the application, wrs are the deleted ranges,
+// ws is sorted and ms is the sorted subset of ws written by merge operands.
+func (s *scheduler) Commit(id uint64, lvl int, wts uint64, rmp map[string]uint64, rgs, wrs []*Range, ws, ms []string) (uint64, error) {
+	r := s.call(&message{t: C, id: id, lvl: lvl, wts: wts, rmp: rmp, rgs: rgs, wrs: wrs, ws: ws, ms: ms})
+	return r.ts, r.err
+}
+
+// send passes m to the scheduler unless it is stopped
+func (s *scheduler) send(m *message) error {
+	select {
+	case <-s.dch:
+		return errmsg.DatabaseClosed
+	default:
+	}
+	select {
+	case s.mch <- m:
+		return nil
+	case <-s.dch:
+		return errmsg.DatabaseClosed
+	}
+}
+
+// call passes m to the scheduler and waits for its result,
+// a message queued when the scheduler stops is answered by errmsg.DatabaseClosed.
+func (s *scheduler) call(m *message) *result {
+	m.rch = make(chan *result)
+	if err := s.send(m); err != nil {
+		return &result{err: err}
+	}
+	select {
+	case r := <-m.rch:
+		return r
+	case <-s.dch:
+		return &result{err: errmsg.DatabaseClosed}
+	}
+}
+
 func (s *scheduler) process(m *message) {
 	switch m.t {
 	case S:
-		s.mgr.Add(m.ts)
+		ts := s.vts
+		if m.sup {
+			if ts = m.ts; ts > atomic.LoadUint64(&s.ts) || (!s.mng && ts > s.vts) || ts < s.sts {
+				m.rch <- &result{err: errmsg.InvalidTimestamp}
+				return
+			}
+		}
+		s.id++
+		s.mgr.Add(ts)
+		s.amp[s.id] = &active{ts: ts, t: time.Now(), old: ts < s.gts}
+		m.rch <- &result{id: s.id, ts: ts}
+	case E:
+		s.end(m.id)
+	case O: // the range deletions up to it are settled by the caller
+		s.advance()
+		if s.mts > s.sts {
+			s.sts = s.mts
+		}
+		m.rch <- &result{ts: s.mts}
 	case D:
+		delete(s.pmp, m.ts)
+		s.visible()
 		err := s.cp.endCKPT(m.ts)
 		m.rch <- &result{err: err}
 	case C:
 		var err error
 
-		for k, rts := range m.rmp {
-			if e, ok := s.mp[k]; ok && e.ts > rts {
-				err = errmsg.TransactionConflict
-				m.rch <- &result{err: err}
-				return
-			}
+		defer s.end(m.id)
+		a, ok := s.amp[m.id]
+		if !ok {
+			m.rch <- &result{err: errmsg.TransactionExpired}
+			return
 		}
-		ts := atomic.AddUint64(&s.ts, 1)
-		for k, _ := range m.wmp {
-			if e, ok := s.mp[k]; ok {
-				e.ts = ts
-				iSort(s.xs)
-			} else {
-				e = &element{k: k, ts: ts}
-				s.mp[k] = e
-				s.xs = push(e, s.xs)
-			}
+		m.ts = a.ts
+		switch {
+		case a.old && len(m.ws)+len(m.wrs) > 0: // conflicts can not be validated
+			m.rch <- &result{err: errmsg.InvalidTimestamp}
+			return
+		case s.mng && m.wts == 0:
+			m.rch <- &result{err: errmsg.ManagedTimestamp}
+			return
+		case !s.mng && m.wts != 0:
+			m.rch <- &result{err: errmsg.UnmanagedTimestamp}
+			return
+		case s.mng && (m.wts <= m.ts || m.wts <= atomic.LoadUint64(&s.ts) || m.wts >= mvcc.Long): // the top bit marks long keys
+			m.rch <- &result{err: errmsg.InvalidTimestamp}
+			return
+		}
+		t, err := s.validate(m)
+		if err != nil {
+			m.rch <- &result{err: err}
+			return
 		}
-		if s.mgr.Del(m.ts) {
-			s.mts = m.ts
+		ts := m.wts
+		switch {
+		case s.mng:
+			atomic.StoreUint64(&s.ts, ts)
+		default:
+			ts = atomic.AddUint64(&s.ts, 1)
 		}
+		t.ts = ts
+		s.record(t, m)
 		switch {
 		case s.cp.s:
 			s.cp.mp[ts] = struct{}{}
@@ -115,15 +226,280 @@ func (s *scheduler) process(m *message) {
 		default:
 			s.cp.mq[ts] = struct{}{}
 		}
-		m.rch <- &result{err, ts}
+		if err == nil {
+			s.pmp[ts] = struct{}{}
+		}
+		s.visible()
+		m.rch <- &result{err: err, ts: ts}
+	}
+}
+
+// visible advances the read timestamp of new transactions to the last commit
+// timestamp below which no commit is being applied, so that a snapshot never
+// misses the writes of a transaction committed before it.
+func (s *scheduler) visible() {
+	ts := atomic.LoadUint64(&s.ts)
+	for t, _ := range s.pmp {
+		if t <= ts {
+			ts = t - 1
+		}
+	}
+	s.vts = ts
+}
+
+// validate checks the transaction against the transactions committed after it started.
+// Both levels apply first-committer-wins to the write set except merges, serializable snapshot
+// isolation additionally tracks rw-antidependencies and refuses to commit when the
+// transaction or a committed writer it depends on becomes a pivot of a dangerous structure.
+//
+// A structure T1 -rw-> T2 -rw-> T3 can only break serializability if T3 commits first, so
+// a committed transaction just keeps whether it has an out edge to an earlier commit. The
+// committing transaction is aborted as T1 when a writer it read over has that flag, and as
+// T2 when it has both an in and an out edge. As T3 it commits after the pivot and closes no
+// anomaly, hence no in flag is kept. The flags do not name the transactions at the other
+// end, so a transaction which would serialize may be aborted but no anomaly is committed.
+func (s *scheduler) validate(m *message) (*txn, error) {
+	var in, out string
+
+	t := new(txn)
+	for _, k := range m.ws {
+		if written(m.ms, k) { // merges commute with other writes
+			continue
+		}
+		ts := m.ts
+		if rts, ok := m.rmp[k]; ok && rts > ts { // read under the key lock
+			ts = rts
+		}
+		if e, ok := s.mp[k]; ok && len(e.ws) > 0 && e.ws[len(e.ws)-1].ts > ts {
+			return nil, errmsg.NewConflict(k)
+		}
+		for _, x := range s.ds {
+			if x.t.ts > ts && x.r.Contains(k) {
+				return nil, errmsg.NewConflict(k)
+			}
+		}
+	}
+	for _, r := range m.wrs { // a deleted range is written at every key in it
+		for j := r.seek(s.ks); j < len(s.ks) && r.Contains(s.ks[j]); j++ {
+			if e := s.mp[s.ks[j]]; len(e.ws) > 0 && e.ws[len(e.ws)-1].ts > m.ts {
+				return nil, errmsg.NewConflict(s.ks[j])
+			}
+		}
+	}
+	if m.lvl != SSI {
+		return t, nil
+	}
+	for k, rts := range m.rmp {
+		if e, ok := s.mp[k]; ok {
+			for i := len(e.ws) - 1; i >= 0 && e.ws[i].ts > rts; i-- {
+				if e.ws[i].out { // committed writer becomes a pivot
+					return nil, errmsg.NewConflict(k)
+				}
+				out = k
+			}
+		}
+	}
+	for _, r := range m.rgs { // phantoms
+		for j := r.seek(s.ks); j < len(s.ks) && r.Contains(s.ks[j]); j++ {
+			k, e := s.ks[j], s.mp[s.ks[j]]
+			for i := len(e.ws) - 1; i >= 0 && e.ws[i].ts > m.ts; i-- {
+				if e.ws[i].out {
+					return nil, errmsg.NewConflict(k)
+				}
+				out = k
+			}
+		}
+	}
+	for _, x := range s.ds { // keys deleted after they were read
+		if x.t.ts <= m.ts {
+			continue
+		}
+		k, ok := "", false
+		for rk, rts := range m.rmp {
+			if rts < x.t.ts && x.r.Contains(rk) {
+				k, ok = rk, true
+				break
+			}
+		}
+		for i := 0; !ok && i < len(m.rgs); i++ {
+			k, ok = m.rgs[i].overlap(x.r)
+		}
+		switch {
+		case ok && x.t.out:
+			return nil, errmsg.NewConflict(k)
+		case ok:
+			out = k
+		}
+	}
+	for _, k := range m.ws {
+		if e, ok := s.mp[k]; ok && len(e.rs) > 0 && e.rs[len(e.rs)-1].ts > m.ts {
+			in = k
+		}
+		for _, x := range s.rs {
+			if x.t.ts > m.ts && x.r.Contains(k) {
+				in = k
+			}
+		}
+	}
+	for _, r := range m.wrs {
+		for j := r.seek(s.ks); j < len(s.ks) && r.Contains(s.ks[j]); j++ {
+			if e := s.mp[s.ks[j]]; len(e.rs) > 0 && e.rs[len(e.rs)-1].ts > m.ts {
+				in = s.ks[j]
+			}
+		}
+		for _, x := range s.rs {
+			if k, ok := r.overlap(x.r); ok && x.t.ts > m.ts {
+				in = k
+			}
+		}
+	}
+	switch {
+	case len(out) > 0 && len(in) > 0:
+		return nil, errmsg.NewConflict(out)
+	case len(out) > 0:
+		t.out = true
+	}
+	return t, nil
+}
+
+// record remembers the reads and writes of a committed transaction
+// until no active transaction can conflict with them.
+func (s *scheduler) record(t *txn, m *message) {
+	for _, k := range m.ws {
+		e := s.element(k, t.ts)
+		e.ws = append(prune(e.ws, s.mts), t)
+	}
+	if m.lvl == SSI {
+		for k, _ := range m.rmp {
+			if !written(m.ws, k) {
+				e := s.element(k, t.ts)
+				e.rs = append(prune(e.rs, s.mts), t)
+			}
+		}
+		for _, r := range m.rgs {
+			s.rs = append(s.rs, &scanned{t, r})
+		}
+	}
+	for _, r := range m.wrs {
+		s.ds = append(s.ds, &scanned{t, r})
+	}
+	iSort(s.xs)
+}
+
+func (s *scheduler) element(k string, ts uint64) *element {
+	if e, ok := s.mp[k]; ok {
+		e.ts = ts
+		return e
+	}
+	e := &element{k: k, ts: ts}
+	s.mp[k] = e
+	s.xs = push(e, s.xs)
+	i := sort.SearchStrings(s.ks, k)
+	s.ks = append(s.ks, "")
+	copy(s.ks[i+1:], s.ks[i:])
+	s.ks[i] = k
+	return e
+}
+
+// end releases the snapshot of a transaction
+func (s *scheduler) end(id uint64) {
+	if a, ok := s.amp[id]; ok {
+		delete(s.amp, id)
+		if s.mgr.Del(a.ts) {
+			s.advance()
+		}
+	}
+}
+
+// advance moves the min ts to the oldest read timestamp of the active transactions,
+// the conflict information older than it is discarded.
+func (s *scheduler) advance() {
+	if ts, ok := s.mgr.Min(); ok {
+		s.mts = ts
+	} else {
+		s.mts = s.vts
+	}
+	if s.mts > s.gts {
+		s.gts = s.mts
+	}
+}
+
+// expire logs the transactions running longer than constant.TransactionWarnTime
+// and aborts those exceeding constant.MaxTransactionLifetime.
+func (s *scheduler) expire() {
+	now := time.Now()
+	for id, a := range s.amp {
+		d := now.Sub(a.t)
+		switch {
+		case constant.MaxTransactionLifetime > 0 && d > constant.MaxTransactionLifetime:
+			s.log.Infof("transaction %v reading at %v is aborted after %v\n", id, a.ts, d)
+			s.end(id)
+			s.lt.Release(id)
+		case !a.w && constant.TransactionWarnTime > 0 && d > constant.TransactionWarnTime:
+			a.w = true
+			s.log.Infof("transaction %v reading at %v is running for %v, it may be leaked\n", id, a.ts, d)
+		}
 	}
 }
 
 func (s *scheduler) gc() {
+	s.expire()
+	s.advance()
+	n := len(s.mp)
 	for len(s.xs) > 0 && s.xs[0].ts < s.mts {
 		delete(s.mp, s.xs[0].k)
 		s.xs = s.xs[1:]
 	}
+	if len(s.mp) < n {
+		ks := s.ks[:0]
+		for _, k := range s.ks {
+			if _, ok := s.mp[k]; ok {
+				ks = append(ks, k)
+			}
+		}
+		s.ks = ks
+	}
+	for len(s.rs) > 0 && s.rs[0].t.ts < s.mts {
+		s.rs = s.rs[1:]
+	}
+	for len(s.ds) > 0 && s.ds[0].t.ts < s.mts {
+		s.ds = s.ds[1:]
+	}
+}
+
+// seek returns the position of the first key of the sorted keys ks which may be in r,
+// the keys in r follow it up to the first one out of r.
+func (r *Range) seek(ks []string) int {
+	return sort.SearchStrings(ks, r.lower())
+}
+
+// lower returns the smallest key which may be in r
+func (r *Range) lower() string {
+	if string(r.Start) > string(r.Prefix) {
+		return string(r.Start)
+	}
+	return string(r.Prefix)
+}
+
+// overlap returns the first key in both r and x if there is one.
+func (r *Range) overlap(x *Range) (string, bool) {
+	k := r.lower()
+	if xk := x.lower(); xk > k {
+		k = xk
+	}
+	return k, r.Contains(k) && x.Contains(k)
+}
+
+func (r *Range) Contains(k string) bool {
+	switch {
+	case !strings.HasPrefix(k, string(r.Prefix)):
+		return false
+	case r.Start != nil && k < string(r.Start):
+		return false
+	case r.End != nil && (k > string(r.End) || r.Open && k == string(r.End)):
+		return false
+	}
+	return true
 }
 
 func (c *checkpoint) endCKPT(t uint64) error {
@@ -135,7 +511,9 @@ func (c *checkpoint) endCKPT(t uint64) error {
 		c.s = true
 		c.t = time.Now()
 		c.mp, c.mq = c.mq, c.mp
-		c.c.Flush()
+		for _, x := range c.cs {
+			x.Flush()
+		}
 		if err := c.d.Flush(); err != nil {
 			return err
 		}
@@ -169,6 +547,19 @@ func push(x *element, xs []*element) []*element {
 	return xs
 }
 
+// written reports whether k is in the sorted write set ws.
+func written(ws []string, k string) bool {
+	i := sort.SearchStrings(ws, k)
+	return i < len(ws) && ws[i] == k
+}
+
+func prune(xs []*txn, ts uint64) []*txn {
+	for len(xs) > 0 && xs[0].ts < ts {
+		xs = xs[1:]
+	}
+	return xs
+}
+
 func iSort(xs []*element) {
 	n := len(xs)
 	if n < 2 {
@@ -5,8 +5,10 @@ import (
 
 	"github.com/infinivision/gaeadb/cache"
 	"github.com/infinivision/gaeadb/data"
+	"github.com/infinivision/gaeadb/locker"
 	"github.com/infinivision/gaeadb/scheduler/manager"
 	"github.com/infinivision/gaeadb/wal"
+	"github.com/nnsgmsone/damrey/logger"
 )
 
 const (
@@ -21,36 +23,85 @@ const (
 	CkptSize = 1024 * 1024
 )
 
+const (
+	SSI = iota // serializable snapshot isolation
+	SI         // snapshot isolation
+)
+
 const (
 	C = iota // commit
 	D        // done
 	S        // start
+	E        // end
+	O        // oldest snapshot
 )
 
 type Scheduler interface {
 	Run()
 	Stop()
-	Start() uint64
+	Start() (uint64, uint64)
+	StartAt(uint64) (uint64, error)
+	Resume(uint64) (uint64, error)
+	End(uint64) error
 	Done(uint64) error
-	Commit(uint64, map[string]uint64, map[string][]byte) (uint64, error)
+	Oldest() (uint64, error)
+	Commit(uint64, int, uint64, map[string]uint64, []*Range, []*Range, []string, []string) (uint64, error)
+}
+
+// Range is a key range scanned or deleted by a transaction, it covers the keys
+// with Prefix between Start and End, a nil bound is unbounded.
+type Range struct {
+	Open   bool // End itself is not covered
+	Prefix []byte
+	Start  []byte
+	End    []byte
 }
 
 type result struct {
 	err error
+	id  uint64
 	ts  uint64
 }
 
 type message struct {
 	t   int
+	lvl int  // isolation level
+	sup bool // read timestamp supplied by application
+	id  uint64
 	ts  uint64
+	wts uint64 // commit timestamp supplied by application
 	rch chan *result
 	rmp map[string]uint64
-	wmp map[string][]byte
+	ws  []string // written keys in order
+	ms  []string // keys written by merge operands only, in order
+	rgs []*Range
+	wrs []*Range // deleted ranges
+}
+
+// active is a running transaction
+type active struct {
+	w   bool // warned
+	old bool // read timestamp is older than the discarded conflict information
+	ts  uint64
+	t   time.Time
+}
+
+// txn is a committed transaction
+type txn struct {
+	ts  uint64
+	out bool // rw-antidependency to a transaction committed before it, see validate
+}
+
+type scanned struct {
+	t *txn
+	r *Range
 }
 
 type element struct {
 	k  string
 	ts uint64
+	ws []*txn // writers
+	rs []*txn // readers
 }
 
 type checkpoint struct {
@@ -58,18 +109,31 @@ type checkpoint struct {
 	t  time.Time
 	d  data.Data
 	w  wal.Writer
-	c  cache.Cache
+	cs []cache.Cache // caches of the indexes
 	mp map[uint64]struct{}
 	mq map[uint64]struct{} // backup
 }
 
 type scheduler struct {
+	id  uint64 // last transaction id
 	ts  uint64
+	vts uint64 // read timestamp of new transactions, every commit up to it is applied
 	mts uint64 // min ts
+	gts uint64 // conflict information older than it is discarded
+	sts uint64 // range deletions up to it are settled, no snapshot starts below it
+	mng bool   // timestamps are managed by application
+	log logger.Log
+	lt  locker.KeyTable
+	amp map[uint64]*active
 	xs  []*element
+	rs  []*scanned // ranges scanned by committed transactions
+	ds  []*scanned // ranges deleted by committed transactions
 	cp  *checkpoint
 	ch  chan struct{}
+	dch chan struct{} // closed once the scheduler is stopped
 	mch chan *message
 	mgr manager.Manager
 	mp  map[string]*element
+	ks  []string            // keys of mp in order
+	pmp map[uint64]struct{} // commits being applied
 }
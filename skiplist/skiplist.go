@@ -0,0 +1,179 @@
+package skiplist
+
+import "strings"
+
+func New() *skiplist {
+	return &skiplist{
+		lvl:  1,
+		r:    Seed,
+		head: &node{next: make([]*node, MaxLevel)},
+	}
+}
+
+func (s *skiplist) Len() int {
+	return s.n
+}
+
+func (s *skiplist) Get(k string) ([]byte, bool) {
+	if n := s.seek(k, nil); n != nil && n.k == k {
+		return n.v, true
+	}
+	return nil, false
+}
+
+func (s *skiplist) Set(k string, v []byte) {
+	var ps [MaxLevel]*node
+
+	if n := s.seek(k, ps[:]); n != nil && n.k == k {
+		n.v = v
+		return
+	}
+	lvl := s.level()
+	if lvl > s.lvl {
+		for i := s.lvl; i < lvl; i++ {
+			ps[i] = s.head
+		}
+		s.lvl = lvl
+	}
+	n := &node{k: k, v: v, prev: ps[0], next: make([]*node, lvl)}
+	for i := 0; i < lvl; i++ {
+		n.next[i] = ps[i].next[i]
+		ps[i].next[i] = n
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = n
+	}
+	s.n++
+}
+
+func (s *skiplist) Del(k string) {
+	var ps [MaxLevel]*node
+
+	n := s.seek(k, ps[:])
+	if n == nil || n.k != k {
+		return
+	}
+	for i := 0; i < len(n.next); i++ {
+		ps[i].next[i] = n.next[i]
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = n.prev
+	}
+	for s.lvl > 1 && s.head.next[s.lvl-1] == nil {
+		s.lvl--
+	}
+	s.n--
+}
+
+// NewForwardIterator returns an iterator over the keys with prefix pref in ascending order.
+func (s *skiplist) NewForwardIterator(pref []byte) Iterator {
+	itr := &forwardIterator{pref: string(pref), n: s.seek(string(pref), nil)}
+	if itr.n != nil && !strings.HasPrefix(itr.n.k, itr.pref) {
+		itr.n = nil
+	}
+	return itr
+}
+
+// NewBackwardIterator returns an iterator over the keys with prefix pref in descending order.
+func (s *skiplist) NewBackwardIterator(pref []byte) Iterator {
+	itr := &backwardIterator{pref: string(pref), head: s.head}
+	switch end := successor(pref); {
+	case end == nil:
+		itr.n = s.last()
+	default:
+		if n := s.seek(string(end), nil); n != nil {
+			itr.n = n.prev
+		} else {
+			itr.n = s.last()
+		}
+	}
+	if itr.n == s.head || (itr.n != nil && !strings.HasPrefix(itr.n.k, itr.pref)) {
+		itr.n = nil
+	}
+	return itr
+}
+
+// seek returns the first node whose key is not less than k,
+// the predecessors of every level are stored in ps if ps is not nil.
+func (s *skiplist) seek(k string, ps []*node) *node {
+	x := s.head
+	for i := s.lvl - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].k < k {
+			x = x.next[i]
+		}
+		if ps != nil {
+			ps[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (s *skiplist) last() *node {
+	x := s.head
+	for i := s.lvl - 1; i >= 0; i-- {
+		for x.next[i] != nil {
+			x = x.next[i]
+		}
+	}
+	return x
+}
+
+func (s *skiplist) level() int {
+	s.r ^= s.r << 13
+	s.r ^= s.r >> 7
+	s.r ^= s.r << 17
+	lvl := 1
+	for x := s.r; lvl < MaxLevel && x%P == 0; x /= P {
+		lvl++
+	}
+	return lvl
+}
+
+func (itr *forwardIterator) Next() {
+	if itr.n = itr.n.next[0]; itr.n != nil && !strings.HasPrefix(itr.n.k, itr.pref) {
+		itr.n = nil
+	}
+}
+
+func (itr *forwardIterator) Valid() bool {
+	return itr.n != nil
+}
+
+func (itr *forwardIterator) Key() string {
+	return itr.n.k
+}
+
+func (itr *forwardIterator) Value() []byte {
+	return itr.n.v
+}
+
+func (itr *backwardIterator) Next() {
+	if itr.n = itr.n.prev; itr.n == itr.head || (itr.n != nil && !strings.HasPrefix(itr.n.k, itr.pref)) {
+		itr.n = nil
+	}
+}
+
+func (itr *backwardIterator) Valid() bool {
+	return itr.n != nil
+}
+
+func (itr *backwardIterator) Key() string {
+	return itr.n.k
+}
+
+func (itr *backwardIterator) Value() []byte {
+	return itr.n.v
+}
+
+// successor returns the least key greater than every key with prefix pref,
+// nil means there is no such key.
+func successor(pref []byte) []byte {
+	end := append([]byte{}, pref...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package skiplist
+
+const (
+	MaxLevel = 16
+	P        = 4 // a node of level i is promoted to level i+1 with probability 1/P
+	Seed     = 0x9E3779B97F4A7C15
+)
+
+// SkipList keeps the key-value pairs ordered by key.
+type SkipList interface {
+	Len() int
+	Del(string)
+	Get(string) ([]byte, bool)
+	Set(string, []byte)
+
+	NewForwardIterator([]byte) Iterator
+	NewBackwardIterator([]byte) Iterator
+}
+
+type Iterator interface {
+	Next()
+	Valid() bool
+	Key() string
+	Value() []byte
+}
+
+type node struct {
+	k    string
+	v    []byte
+	prev *node // previous node of level 0
+	next []*node
+}
+
+type forwardIterator struct {
+	pref string
+	n    *node
+}
+
+type backwardIterator struct {
+	pref string
+	n    *node
+	head *node
+}
+
+type skiplist struct {
+	n    int // number of keys
+	lvl  int
+	r    uint64 // xorshift state choosing the levels of nodes
+	head *node
+}
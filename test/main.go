@@ -6,6 +6,7 @@ import (
 	"log"
 
 	"github.com/infinivision/gaeadb/db"
+	"github.com/infinivision/gaeadb/transaction"
 )
 
 func main() {
@@ -36,7 +37,7 @@ func main() {
 		}
 	}
 	{
-		tx, err := db.NewTransaction(false)
+		tx, err := db.NewTransaction(false, transaction.Serializable)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -54,7 +55,7 @@ func main() {
 		itr.Close()
 	}
 	{
-		tx, err := db.NewTransaction(false)
+		tx, err := db.NewTransaction(false, transaction.Serializable)
 		if err != nil {
 			log.Fatal(err)
 		}
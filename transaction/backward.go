@@ -1,25 +1,25 @@
 package transaction
 
 import (
-	"bytes"
-	"encoding/binary"
 	"sort"
 
 	"github.com/infinivision/gaeadb/constant"
+	"github.com/infinivision/gaeadb/data"
 	"github.com/infinivision/gaeadb/errmsg"
 )
 
 func (itr *backwardIterator) Close() error {
+	if itr.itr == nil {
+		return nil
+	}
 	return itr.itr.Close()
 }
 
 func (itr *backwardIterator) Next() error {
+	itr.last = itr.kv.ks[0]
 	delete(itr.kv.mp, string(itr.kv.ks[0]))
 	delete(itr.kv.omp, string(itr.kv.ks[0]))
 	if itr.kv.ks = itr.kv.ks[1:]; len(itr.kv.ks) == 0 {
-		if err := itr.itr.Next(); err != nil {
-			return err
-		}
 		return itr.seek()
 	}
 	return nil
@@ -33,7 +33,7 @@ func (itr *backwardIterator) Valid() bool {
 }
 
 func (itr *backwardIterator) Key() []byte {
-	return itr.kv.ks[0]
+	return itr.kv.ks[0][1:]
 }
 
 func (itr *backwardIterator) Value() ([]byte, error) {
@@ -44,8 +44,11 @@ func (itr *backwardIterator) Value() ([]byte, error) {
 	case constant.Delete:
 		return nil, errmsg.NotExist
 	case constant.Cache:
-		if v, ok := itr.tx.wmp[k]; ok {
-			if v == nil {
+		if v, ok, err := itr.tx.get(k); ok {
+			switch {
+			case err != nil:
+				return nil, err
+			case v == nil:
 				return nil, errmsg.NotExist
 			}
 			return v, nil
@@ -53,6 +56,8 @@ func (itr *backwardIterator) Value() ([]byte, error) {
 	default:
 		if v, ok := itr.kv.mp[k]; ok {
 			return v, nil
+		} else if itr.opt.KeysOnly {
+			return itr.tx.deferred([]byte(k), o)
 		} else {
 			return nil, errmsg.ReadFailed
 		}
@@ -60,84 +65,118 @@ func (itr *backwardIterator) Value() ([]byte, error) {
 	return itr.kv.mp[string(itr.kv.ks[0])], nil
 }
 
+// Cursor returns the position after the keys passed by Next.
+func (itr *backwardIterator) Cursor() []byte {
+	return itr.tx.cursor(itr.opt, itr.pref[1:], untag(itr.last))
+}
+
+// seek merges the snapshot with the pending writes in a single pass,
+// a pending write shadows the snapshot version of its key.
 func (itr *backwardIterator) seek() error {
-	for itr.itr.Valid() {
-		key := string(itr.itr.Key())
-		if !itr.tx.ro {
-			for k, _ := range itr.tx.wmp {
-				if bytes.Compare([]byte(k), []byte(key)) < 0 {
-					itr.kv.omp[k] = constant.Cache
-					itr.kv.ks = GtPush([]byte(k), itr.kv.ks)
-				}
+	for len(itr.kv.ks) < itr.opt.BatchSize {
+		var key string
+
+		ok := itr.itr != nil && itr.itr.Valid()
+		if ok {
+			key = string(itr.itr.Key())
+		}
+		switch {
+		case itr.wi.Valid() && (!ok || itr.wi.Key() >= key):
+			k, v := itr.wi.Key(), itr.wi.Value()
+			itr.wi.Next()
+			if (v != nil || itr.tx.mmp[k]) && !itr.tx.lapsed(k) { // a pending delete hides the key
+				itr.push(k, constant.Cache)
 			}
-			if _, ok := itr.tx.wmp[key]; !ok {
-				itr.tx.rmp[key] = itr.itr.Timestamp()
+			if !ok || k != key {
+				continue
 			}
-		}
-		itr.kv.omp[key] = itr.itr.Value()
-		itr.kv.ks = append(itr.kv.ks, []byte(key))
-		if len(itr.kv.ks) > constant.PreLoad {
+		case !ok:
+			itr.scanEnd()
 			itr.fill()
 			return nil
+		default:
+			if !itr.tx.ro {
+				itr.tx.read(key, itr.itr.Timestamp())
+			}
+			switch o := itr.itr.Value(); {
+			case o == constant.Delete: // deleted in the snapshot
+			case itr.opt.KeysOnly && o&data.ExpireMark == 0: // read by Value
+				itr.push(key, o)
+			case itr.opt.KeysOnly: // only the expiry time is read
+				ok, err := itr.tx.expired(o)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					itr.push(key, o)
+				}
+			case o&data.MergeMark != 0: // combined at once
+				v, _, err := itr.tx.resolve([]byte(key), itr.tx.rts)
+				if err != nil {
+					return err
+				}
+				itr.push(key, o)
+				itr.kv.mp[key] = v
+			case o&data.ExpireMark == 0:
+				itr.push(key, o)
+				if v, ok := peek(itr.itr); ok {
+					itr.kv.mp[key] = v
+				}
+			default: // loaded at once to skip an expired key
+				v, ok, err := itr.tx.prefetched(itr.itr, o)
+				if err != nil {
+					return err
+				}
+				if ok {
+					itr.push(key, o)
+					itr.kv.mp[key] = v
+				}
+			}
 		}
-		err := itr.itr.Next()
-		switch {
-		case err == errmsg.ScanEnd:
-			itr.fill()
-			return nil
-		case err != nil:
+		if err := itr.itr.Next(); err != nil && err != errmsg.ScanEnd {
 			return err
 		}
 	}
-	return errmsg.ScanEnd
+	itr.fill()
+	return nil
 }
 
-func (itr *backwardIterator) fill() {
-	min, max := itr.kv.omp[string(itr.kv.ks[0])], itr.kv.omp[string(itr.kv.ks[0])]
-	for _, k := range itr.kv.ks {
-		if o := itr.kv.omp[string(k)]; o > constant.Cache {
-			switch {
-			case o < min:
-				min = o
-			case o > max:
-				max = o
-			}
-		}
+func (itr *backwardIterator) push(k string, o uint64) {
+	if itr.r != nil {
+		itr.r.Start = []byte(k)
 	}
-	buf, err := itr.tx.d.Load(min, int(max-min)+32) // preload
-	switch {
-	case err == nil:
-		for _, k := range itr.kv.ks {
-			if o := itr.kv.omp[string(k)]; o > constant.Cache {
-				if int(o-min)+2 < len(buf) {
-					n := int(binary.LittleEndian.Uint16(buf[o-min:]))
-					if len(buf[o-min+2:]) >= n {
-						itr.kv.mp[string(k)] = buf[int(o-min)+2 : int(o-min)+2+n]
-						continue
-					}
-				}
-				if v, err := itr.tx.d.Read(o); err == nil {
-					itr.kv.mp[string(k)] = v
-				}
-			}
-		}
-	case err != nil:
-		itr.tx.log.Errorf("forwardIterator -  failed to preLoad: %v\n", err)
-		for _, k := range itr.kv.ks {
-			if o := itr.kv.omp[string(k)]; o > constant.Cache {
-				if v, err := itr.tx.d.Read(o); err == nil {
-					itr.kv.mp[string(k)] = v
-				}
-			}
-		}
+	if v, ok := data.Inlined(o); ok {
+		itr.kv.mp[k] = v
+	}
+	itr.kv.omp[k] = o
+	itr.kv.ks = append(itr.kv.ks, []byte(k))
+}
+
+func (itr *backwardIterator) scanEnd() {
+	if itr.r != nil {
+		itr.r.Start = nil
 	}
 }
 
-func GtPush(x []byte, xs [][]byte) [][]byte {
-	i := sort.Search(len(xs), func(i int) bool { return bytes.Compare(xs[i], x) <= 0 })
-	xs = append(xs, []byte{})
-	copy(xs[i+1:], xs[i:])
-	xs[i] = x
-	return xs
+func (itr *backwardIterator) fill() {
+	var ks []string
 
+	if itr.opt.KeysOnly {
+		return
+	}
+	for _, k := range itr.kv.ks {
+		if _, ok := itr.kv.mp[string(k)]; !ok && stored(itr.kv.omp[string(k)]) {
+			ks = append(ks, string(k))
+		}
+	}
+	sort.Slice(ks, func(i, j int) bool { return itr.kv.omp[ks[i]] < itr.kv.omp[ks[j]] })
+	os := make([]uint64, len(ks))
+	for i, k := range ks {
+		os[i] = itr.kv.omp[k]
+	}
+	if err := itr.tx.coalesce(itr.ra, os, func(i int, v []byte) {
+		itr.kv.mp[ks[i]] = v
+	}); err != nil {
+		itr.tx.log.Errorf("backwardIterator - failed to read: %v\n", err)
+	}
 }
@@ -0,0 +1,98 @@
+package transaction
+
+import (
+	"sort"
+	"time"
+
+	"github.com/infinivision/gaeadb/constant"
+	"github.com/infinivision/gaeadb/data"
+	"github.com/infinivision/gaeadb/errmsg"
+)
+
+// GetMany returns the values of ks in order, the value of a key which does not exist is nil.
+// The keys are looked up in order sharing the descents of common prefixes, and the values
+// close to each other in the data file are read together.
+func (tx *transaction) GetMany(ks [][]byte) ([][]byte, error) {
+	var is []int
+	var xs [][]byte
+
+	vs := make([][]byte, len(ks))
+	for i, k := range ks {
+		if len(k) == 0 {
+			return nil, errmsg.KeyIsEmpty
+		}
+		if k = tx.key(k); !tx.ro {
+			if v, ok, err := tx.get(string(k)); ok {
+				if err != nil {
+					return nil, err
+				}
+				vs[i] = v
+				continue
+			}
+		}
+		is, xs = append(is, i), append(xs, k)
+	}
+	os, ts, err := tx.m.GetMany(xs, tx.rts)
+	if err != nil {
+		return nil, err
+	}
+	mp := make(map[uint64][]int) // offsets read from the data file
+	for j, i := range is {
+		k, o := xs[j], os[j]
+		if ts[j] == 0 || o == constant.Delete {
+			if !tx.ro {
+				tx.read(string(k), tx.rts)
+			}
+			continue
+		}
+		if !tx.ro {
+			tx.read(string(k), ts[j])
+		}
+		if o&data.MergeMark != 0 {
+			if vs[i], _, err = tx.resolve(k, tx.rts); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if o == constant.Empty {
+			vs[i] = []byte{}
+			continue
+		}
+		if v, ok := data.Inlined(o); ok {
+			vs[i] = v
+			continue
+		}
+		mp[o] = append(mp[o], i)
+	}
+	return vs, tx.gather(mp, vs)
+}
+
+// gather reads the values at the offsets of mp into vs, the offsets are
+// read in order and the values close enough are loaded by a single read.
+func (tx *transaction) gather(mp map[uint64][]int, vs [][]byte) error {
+	os := make([]uint64, 0, len(mp))
+	for o, _ := range mp {
+		os = append(os, o)
+	}
+	sort.Slice(os, func(i, j int) bool { return os[i]&^data.ExpireMark < os[j]&^data.ExpireMark })
+	var rerr error
+	if err := tx.coalesce(newReadahead(0), os, func(i int, v []byte) {
+		if os[i]&data.ExpireMark != 0 {
+			dl, x, err := data.Expiry(v)
+			switch {
+			case err != nil:
+				rerr = err
+				return
+			case dl <= time.Now().UnixNano():
+				return
+			}
+			v = x
+		}
+		for _, k := range mp[os[i]] {
+			vs[k] = v
+		}
+	}); err != nil {
+		return err
+	}
+	return rerr
+}
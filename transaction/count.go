@@ -0,0 +1,156 @@
+package transaction
+
+import (
+	"bytes"
+	"math/rand"
+
+	"github.com/infinivision/gaeadb/constant"
+	"github.com/infinivision/gaeadb/data"
+	"github.com/infinivision/gaeadb/errmsg"
+)
+
+// Count returns the number of keys with prefix pref, the keys are scanned without their values.
+func (tx *transaction) Count(pref []byte) (int, error) {
+	n, _, err := tx.tally(tx.key(pref), false)
+	return n, err
+}
+
+// Estimate returns the approximate number of keys with prefix pref and their size, which is
+// the length of the keys and the values. The index below pref is descended by a budget of
+// constant.Descents suffix nodes whose keys are counted, a prefix node shares the budget among
+// its branches and samples as many branches as the budget allows if it has more, the keys
+// found below the sampled branches are scaled by the fanout. The estimate is exact if the
+// budget covers the branches passed, and it is stable for a read timestamp.
+func (tx *transaction) Estimate(pref []byte) (uint64, uint64, error) {
+	n, s, err := tx.descend(tx.key(pref), constant.Descents, rand.New(rand.NewSource(int64(tx.rts))))
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(n + 0.5), uint64(s + 0.5), nil
+}
+
+// descend returns the estimated number and size of the keys with prefix k with budget b
+func (tx *transaction) descend(k []byte, b int, r *rand.Rand) (float64, float64, error) {
+	var n, s float64
+
+	bs, err := tx.m.Fanout(k)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(bs) == 0 {
+		x, y, err := tx.tally(k, true)
+		return float64(x), float64(y), err
+	}
+	if len(k) > 1 && bs[0] == 0 { // the versions of k follow it by the zero byte of their timestamps
+		m, ok, err := tx.measure(k[1:])
+		if err != nil {
+			return 0, 0, err
+		}
+		if ok {
+			n, s = 1, float64(len(k)+m)
+		}
+	}
+	w := 1.0
+	if len(bs) > b {
+		w = float64(len(bs)) / float64(b)
+		xs := make([]byte, 0, b)
+		for _, i := range r.Perm(len(bs))[:b] {
+			xs = append(xs, bs[i])
+		}
+		bs = xs
+	}
+	for i, c := range bs {
+		x, y, err := tx.descend(append(append([]byte{}, k...), c), b/len(bs)+share(i, b%len(bs)), r)
+		if err != nil {
+			return 0, 0, err
+		}
+		n, s = n+w*x, s+w*y
+	}
+	return n, s, nil
+}
+
+// share returns 1 for the first m of the branches sharing the rest of a budget
+func share(i, m int) int {
+	if i < m {
+		return 1
+	}
+	return 0
+}
+
+// tally returns the number of keys with the tagged prefix pref and their size if sz
+func (tx *transaction) tally(pref []byte, sz bool) (int, int, error) {
+	var n, s int
+
+	itr, err := tx.newForwardIterator(pref[1:], IteratorOptions{KeysOnly: true})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer itr.Close()
+	fitr := itr.(*forwardIterator)
+	for fitr.Valid() {
+		if k := fitr.Key(); bytes.HasPrefix(k, pref[1:]) { // the iterator may return pref without its last byte
+			m, ok, err := fitr.size(sz)
+			if err != nil {
+				return 0, 0, err
+			}
+			if ok {
+				n, s = n+1, s+len(k)+m
+			}
+		}
+		if err := fitr.Next(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return n, s, nil
+}
+
+// measure returns the length of the value of k and whether k exists
+func (tx *transaction) measure(k []byte) (int, bool, error) {
+	v, o, _, err := tx.lookup(k)
+	switch {
+	case err == errmsg.NotExist:
+		return 0, false, nil
+	case err != nil:
+		return 0, false, err
+	case o == constant.Cancel:
+		return len(v), true, nil
+	}
+	return tx.length(o)
+}
+
+// length returns the length of the value at o read from its header
+func (tx *transaction) length(o uint64) (int, bool, error) {
+	n, err := tx.d.Size(o &^ data.ExpireMark)
+	if err != nil {
+		return 0, false, err
+	}
+	if o&data.ExpireMark != 0 { // the expiry time
+		n -= 8
+	}
+	return n, true, nil
+}
+
+// size returns the length of the current value and whether the key exists,
+// the length of a value in the data file is read only if sz.
+func (itr *forwardIterator) size(sz bool) (int, bool, error) {
+	k := string(itr.kv.ks[0])
+	switch o := itr.kv.omp[k]; {
+	case o == constant.Delete:
+		return 0, false, nil
+	case o == constant.Cache || o&data.MergeMark != 0:
+		v, err := itr.Value()
+		switch {
+		case err == errmsg.NotExist:
+			return 0, false, nil
+		case err != nil:
+			return 0, false, err
+		}
+		return len(v), true, nil
+	case readable(o):
+		if !sz {
+			return 0, true, nil
+		}
+		return itr.tx.length(o)
+	}
+	return len(itr.kv.mp[k]), true, nil
+}
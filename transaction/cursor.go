@@ -0,0 +1,218 @@
+package transaction
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/infinivision/gaeadb/data"
+	"github.com/infinivision/gaeadb/errmsg"
+	"github.com/infinivision/gaeadb/locker"
+	"github.com/infinivision/gaeadb/merge"
+	"github.com/infinivision/gaeadb/mvcc"
+	"github.com/infinivision/gaeadb/scheduler"
+	"github.com/infinivision/gaeadb/wal"
+	"github.com/nnsgmsone/damrey/logger"
+)
+
+// NewFromCursor creates a read-only transaction to resume the cursor c,
+// it reads at the snapshot of c if c keeps its read timestamp.
+func NewFromCursor(c []byte, d data.Data, m mvcc.Space, w wal.Writer, lt locker.KeyTable, log logger.Log, schd scheduler.Scheduler, ops merge.Operators) (*transaction, error) {
+	cur, err := decodeCursor(c)
+	if err != nil {
+		return nil, err
+	}
+	if !cur.opt.Snapshot {
+		return New(true, false, Serializable, d, m, w, lt, log, schd, ops), nil
+	}
+	id, err := schd.Resume(cur.ts)
+	if err != nil {
+		return nil, err
+	}
+	return newTransaction(true, false, Serializable, id, cur.ts, d, m, w, lt, log, schd, ops), nil
+}
+
+// Resume continues the scan of the cursor c, a cursor keeping its read timestamp
+// is resumed only by a transaction reading at that timestamp.
+func (tx *transaction) Resume(c []byte) (Iterator, error) {
+	cur, err := decodeCursor(c)
+	if err != nil {
+		return nil, err
+	}
+	if cur.opt.Snapshot && cur.ts != tx.rts {
+		return nil, errmsg.InvalidTimestamp
+	}
+	if cur.last == nil {
+		return tx.NewIterator(cur.pref, cur.opt)
+	}
+	itr := &resumedIterator{tx: tx, cur: cur, l: cur.last}
+	switch {
+	case cur.opt.Reverse:
+		itr.i, itr.c = len(cur.last), int(cur.last[len(cur.last)-1])-1
+	default:
+		itr.i = len(cur.last) + 1 // the keys extending last come first
+	}
+	if err := itr.seek(); err != nil {
+		itr.Close()
+		return nil, err
+	}
+	return itr, nil
+}
+
+func (itr *resumedIterator) Close() error {
+	if itr.itr == nil {
+		return nil
+	}
+	return itr.itr.Close()
+}
+
+func (itr *resumedIterator) Next() error {
+	itr.cur.last = itr.k
+	if !itr.seg.exact {
+		if err := itr.itr.Next(); err != nil {
+			return err
+		}
+	}
+	return itr.seek()
+}
+
+func (itr *resumedIterator) Valid() bool {
+	return itr.k != nil
+}
+
+func (itr *resumedIterator) Key() []byte {
+	return itr.k
+}
+
+func (itr *resumedIterator) Value() ([]byte, error) {
+	if itr.seg.exact {
+		return itr.v, nil
+	}
+	return itr.itr.Value()
+}
+
+func (itr *resumedIterator) Cursor() []byte {
+	return itr.tx.cursor(itr.cur.opt, itr.cur.pref, itr.cur.last)
+}
+
+// seek moves to the next key of the segments, the iterator of a segment
+// may return keys around its prefix which are skipped.
+func (itr *resumedIterator) seek() error {
+	var err error
+
+	itr.k = nil
+	for {
+		if itr.itr != nil {
+			for itr.itr.Valid() {
+				if k := itr.itr.Key(); bytes.HasPrefix(k, itr.seg.pref) && !bytes.Equal(k, itr.l) {
+					itr.k = k
+					return nil
+				}
+				if err := itr.itr.Next(); err != nil {
+					return err
+				}
+			}
+			itr.itr.Close()
+			itr.itr = nil
+		}
+		if itr.seg = itr.next(); itr.seg == nil {
+			return nil
+		}
+		if !itr.seg.exact {
+			if itr.itr, err = itr.tx.NewIterator(itr.seg.pref, itr.cur.opt); err != nil {
+				return err
+			}
+			continue
+		}
+		switch v, err := itr.tx.Get(itr.seg.pref); {
+		case err == nil:
+			itr.k, itr.v = itr.seg.pref, v
+			return nil
+		case err != errmsg.NotExist:
+			return err
+		}
+	}
+}
+
+// next returns the next segment, the keys after l with prefix pref are l's extensions
+// followed by the prefixes l[:i-1]+c with c greater than l[i-1] from the last i, the
+// keys before l are the prefixes l[:i-1]+c with c less than l[i-1] and l[:i-1] itself.
+func (itr *resumedIterator) next() *segment {
+	l, n := itr.l, len(itr.cur.pref)
+	if !itr.cur.opt.Reverse {
+		if itr.i > len(l) {
+			itr.i, itr.c = len(l), int(l[len(l)-1])+1
+			return &segment{pref: l}
+		}
+		for itr.i > n {
+			if itr.c <= 0xFF {
+				itr.c++
+				return &segment{pref: append(append([]byte{}, l[:itr.i-1]...), byte(itr.c-1))}
+			}
+			if itr.i--; itr.i > n {
+				itr.c = int(l[itr.i-1]) + 1
+			}
+		}
+		return nil
+	}
+	for itr.i > n {
+		if itr.c >= 0 {
+			itr.c--
+			return &segment{pref: append(append([]byte{}, l[:itr.i-1]...), byte(itr.c+1))}
+		}
+		q := l[:itr.i-1]
+		if itr.i--; itr.i > n {
+			itr.c = int(l[itr.i-1]) - 1
+		}
+		if len(q) > 0 {
+			return &segment{exact: true, pref: q}
+		}
+	}
+	return nil
+}
+
+// cursor encodes the position after last of a scan of pref
+func (tx *transaction) cursor(opt IteratorOptions, pref, last []byte) []byte {
+	var flag byte
+	var ts uint64
+
+	if opt.Reverse {
+		flag |= reverse
+	}
+	if opt.KeysOnly {
+		flag |= keysOnly
+	}
+	if opt.Snapshot {
+		flag |= snapshot
+		ts = tx.rts
+	}
+	buf := make([]byte, 11, 13+len(pref)+len(last))
+	buf[0] = flag
+	binary.LittleEndian.PutUint64(buf[1:], ts)
+	binary.LittleEndian.PutUint16(buf[9:], uint16(len(pref)))
+	buf = append(buf, pref...)
+	buf = append(buf, byte(len(last)), byte(len(last)>>8))
+	return append(buf, last...)
+}
+
+func decodeCursor(buf []byte) (*cursor, error) {
+	if len(buf) < 13 || buf[0]&^(reverse|keysOnly|snapshot) != 0 {
+		return nil, errmsg.InvalidCursor
+	}
+	c := &cursor{ts: binary.LittleEndian.Uint64(buf[1:])}
+	c.opt.Reverse = buf[0]&reverse != 0
+	c.opt.KeysOnly = buf[0]&keysOnly != 0
+	c.opt.Snapshot = buf[0]&snapshot != 0
+	n := int(binary.LittleEndian.Uint16(buf[9:]))
+	if buf = buf[11:]; len(buf) < n+2 {
+		return nil, errmsg.InvalidCursor
+	}
+	c.pref = append([]byte{}, buf[:n]...)
+	m := int(binary.LittleEndian.Uint16(buf[n:]))
+	if buf = buf[n+2:]; len(buf) != m || (c.ts != 0 && !c.opt.Snapshot) || (m > 0 && !bytes.HasPrefix(buf, c.pref)) {
+		return nil, errmsg.InvalidCursor
+	}
+	if m > 0 {
+		c.last = append([]byte{}, buf...)
+	}
+	return c, nil
+}
@@ -0,0 +1,118 @@
+package transaction
+
+import (
+	"bytes"
+
+	"github.com/infinivision/gaeadb/constant"
+	"github.com/infinivision/gaeadb/data"
+	"github.com/infinivision/gaeadb/errmsg"
+	"github.com/infinivision/gaeadb/locker"
+	"github.com/infinivision/gaeadb/mvcc"
+	"github.com/infinivision/gaeadb/scheduler"
+	"github.com/infinivision/gaeadb/wal"
+	"github.com/nnsgmsone/damrey/logger"
+)
+
+// Sweep deletes at most n expired keys after the key last by a transaction and returns the
+// number of deleted keys, the key to resume from, which is nil once the index is swept to
+// its end, and whether a key which expires is visited. A key written again after it expired
+// is kept by the conflict check.
+func Sweep(n int, last []byte, d data.Data, m mvcc.Space, w wal.Writer, lt locker.KeyTable, log logger.Log, schd scheduler.Scheduler) (int, []byte, bool, error) {
+	var cnt int
+	var k []byte
+	var seen bool
+
+	tx := New(false, false, Serializable, d, m, w, lt, log, schd, nil)
+	defer tx.Rollback()
+	end, err := walk(m, last, tx.rts, func(itr mvcc.Iterator) (bool, error) {
+		k = append(k[:0], itr.Key()...)
+		if itr.Value()&data.ExpireMark != 0 {
+			seen = true
+		}
+		switch ok, err := tx.expired(itr.Value()); {
+		case err != nil:
+			return false, err
+		case ok:
+			tx.read(string(k), itr.Timestamp())
+			if err := tx.In(m.Namespaces()[k[0]]).Del(k[1:]); err != nil {
+				return false, err
+			}
+			cnt++
+		}
+		return cnt < n, nil
+	})
+	switch {
+	case err != nil:
+		return 0, nil, false, err
+	case end:
+		k = nil
+	}
+	if cnt == 0 {
+		return 0, k, seen, nil
+	}
+	return cnt, k, seen, tx.Commit()
+}
+
+// walk calls f on the entries of the index after the key l in order until f returns false,
+// it reports whether the end of the index is reached. The keys after l with prefix l[:j+1]
+// come first, where l[:j] is the deepest prefix node on the path of l, followed by the keys
+// with prefix l[:i-1]+c for c greater than l[i-1] from i = j+1 up to the root.
+func walk(m mvcc.Space, l []byte, ts uint64, f func(mvcc.Iterator) (bool, error)) (bool, error) {
+	if len(l) == 0 {
+		return visit(m, nil, nil, ts, f)
+	}
+	var tags []byte // the bytes of the root are the tags of the namespaces
+	for i, _ := range m.Namespaces() {
+		tags = append(tags, byte(i))
+	}
+	bss := [][]byte{tags} // bytes following l[:j] of the prefix nodes
+	for j := 1; j < len(l) && j < constant.MaxSweepDepth; j++ {
+		bs, err := m.Fanout(l[:j])
+		if err != nil {
+			return false, err
+		}
+		if bs == nil {
+			break
+		}
+		bss = append(bss, bs)
+	}
+	if ok, err := visit(m, l[:len(bss)], l, ts, f); !ok || err != nil {
+		return false, err
+	}
+	for i := len(bss); i > 0; i-- {
+		for _, c := range bss[i-1] {
+			if c <= l[i-1] {
+				continue
+			}
+			pref := append(append([]byte{}, l[:i-1]...), c)
+			if ok, err := visit(m, pref, nil, ts, f); !ok || err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// visit calls f on the entries with prefix pref after l, the iterator
+// may return keys around pref which are skipped.
+func visit(m mvcc.Space, pref, l []byte, ts uint64, f func(mvcc.Iterator) (bool, error)) (bool, error) {
+	itr, err := m.NewForwardIterator(pref, ts)
+	switch {
+	case err == errmsg.ScanEnd:
+		return true, nil
+	case err != nil:
+		return false, err
+	}
+	defer itr.Close()
+	for itr.Valid() {
+		if k := itr.Key(); bytes.HasPrefix(k, pref) && bytes.Compare(k, l) > 0 {
+			if ok, err := f(itr); !ok || err != nil {
+				return false, err
+			}
+		}
+		if err := itr.Next(); err != nil && err != errmsg.ScanEnd {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,204 @@
+package transaction
+
+import (
+	"github.com/infinivision/gaeadb/constant"
+	"github.com/infinivision/gaeadb/data"
+	"github.com/infinivision/gaeadb/errmsg"
+	"github.com/infinivision/gaeadb/locker"
+	"github.com/infinivision/gaeadb/merge"
+	"github.com/infinivision/gaeadb/mvcc"
+	"github.com/infinivision/gaeadb/scheduler"
+	"github.com/infinivision/gaeadb/wal"
+	"github.com/nnsgmsone/damrey/logger"
+)
+
+// Merge records the operand x of the merge operator bound to k, the operands
+// are combined on read. A merge neither reads k nor conflicts with other merges of k.
+func (tx *transaction) Merge(k, x []byte) error {
+	switch {
+	case tx.ro:
+		return errmsg.ReadOnlyTransaction
+	case len(k) == 0:
+		return errmsg.KeyIsEmpty
+	case len(k) > constant.MaxKeySize:
+		return errmsg.KeyTooLong
+	case len(x) > constant.MaxValueSize:
+		return errmsg.ValTooLong
+	}
+	op := tx.ops.Find(k)
+	if op == nil {
+		return errmsg.NoMergeOperator
+	}
+	k = tx.key(k)
+	if _, ok := tx.lmp[string(k)]; tx.pes && !ok {
+		if _, err := tx.lock(k); err != nil {
+			return err
+		}
+	}
+	mg := true
+	v, ok, err := tx.pending(string(k))
+	switch {
+	case err != nil:
+		return err
+	case ok: // combined with the pending write
+		if mg = tx.mmp[string(k)]; !mg && tx.lapsed(string(k)) {
+			v = nil
+		}
+		if x, err = op.Merge(v, [][]byte{x}); err != nil {
+			return err
+		}
+		if len(x) > constant.MaxValueSize {
+			return errmsg.ValTooLong
+		}
+		if x == nil {
+			x = []byte{}
+		}
+	}
+	if tx.s += 3 + int64(len(k)+len(x)); tx.s > constant.MaxTransactionSize {
+		return errmsg.OutOfSpace
+	}
+	return tx.write(string(k), x, 0, mg)
+}
+
+// merged combines the pending operand x of k with the value of k in the snapshot.
+func (tx *transaction) merged(k string, x []byte) ([]byte, error) {
+	v, ts, err := tx.resolve([]byte(k), tx.rts)
+	switch {
+	case err == errmsg.NotExist:
+		tx.read(k, tx.rts)
+	case err != nil:
+		return nil, err
+	default:
+		tx.read(k, ts)
+	}
+	op := tx.ops.Find([]byte(k[1:]))
+	if op == nil {
+		return nil, errmsg.NoMergeOperator
+	}
+	if v, err = op.Merge(v, [][]byte{x}); err == nil && v == nil {
+		v = []byte{}
+	}
+	return v, err
+}
+
+// resolve returns the value of k at ts and the timestamp of its latest version,
+// the merge operands are combined with the value they were merged into.
+func (tx *transaction) resolve(k []byte, ts uint64) ([]byte, uint64, error) {
+	var err error
+	var v []byte
+	var vts uint64
+	var xs [][]byte
+
+	if e := tx.m.Versions(k, ts, func(o, ots uint64) bool {
+		if vts == 0 {
+			vts = ots
+		}
+		if o&data.MergeMark == 0 {
+			v, err = tx.fetch(o)
+			return false
+		}
+		var x []byte
+		if x, err = tx.d.Read(o &^ data.MergeMark); err != nil {
+			return false
+		}
+		xs = append(xs, x)
+		return true
+	}); e != nil {
+		return nil, 0, e
+	}
+	switch {
+	case err != nil:
+		return nil, 0, err
+	case vts == 0:
+		return nil, 0, errmsg.NotExist
+	case len(xs) == 0 && v == nil:
+		return nil, vts, errmsg.NotExist
+	case len(xs) == 0:
+		return v, vts, nil
+	}
+	op := tx.ops.Find(k[1:])
+	if op == nil {
+		return nil, 0, errmsg.NoMergeOperator
+	}
+	for i, j := 0, len(xs)-1; i < j; i, j = i+1, j-1 { // in commit order
+		xs[i], xs[j] = xs[j], xs[i]
+	}
+	if v, err = op.Merge(v, xs); err != nil {
+		return nil, 0, err
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return v, vts, nil
+}
+
+// fetch returns the value referred by o, it is nil if the value is deleted or expired.
+func (tx *transaction) fetch(o uint64) ([]byte, error) {
+	switch o {
+	case constant.Delete:
+		return nil, nil
+	case constant.Empty:
+		return []byte{}, nil
+	}
+	if v, ok := data.Inlined(o); ok {
+		return v, nil
+	}
+	v, ok, err := tx.load(o)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Collapse replaces the merge operands of at most n keys after the key last with their
+// combined value and returns the number of keys visited holding operands and the key to
+// resume from, which is nil once the index is visited to its end. Each key is collapsed
+// by its own transaction, a key merged concurrently is left to the next pass.
+func Collapse(n int, last []byte, d data.Data, m mvcc.Space, w wal.Writer, lt locker.KeyTable, log logger.Log, schd scheduler.Scheduler, ops merge.Operators) (int, []byte, error) {
+	var ks [][]byte
+
+	tx := New(true, false, Serializable, d, m, w, lt, log, schd, ops)
+	defer tx.Rollback()
+	end, err := walk(m, last, tx.rts, func(itr mvcc.Iterator) (bool, error) {
+		if itr.Value()&data.MergeMark != 0 {
+			ks = append(ks, append([]byte{}, itr.Key()...))
+		}
+		return len(ks) < n, nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, k := range ks { // the index is written once the walk releases it
+		if err := collapse(k, d, m, w, lt, log, schd, ops); err != nil {
+			return 0, nil, err
+		}
+	}
+	if end || len(ks) == 0 {
+		return len(ks), nil, nil
+	}
+	return len(ks), ks[len(ks)-1], nil
+}
+
+// collapse replaces the merge operands of the tagged key k with their combined value.
+func collapse(k []byte, d data.Data, m mvcc.Space, w wal.Writer, lt locker.KeyTable, log logger.Log, schd scheduler.Scheduler, ops merge.Operators) error {
+	tx := New(false, false, Serializable, d, m, w, lt, log, schd, ops)
+	defer tx.Rollback()
+	v, ts, err := tx.resolve(k, tx.rts)
+	switch {
+	case err == errmsg.NotExist: // deleted since
+		return nil
+	case err == errmsg.NoMergeOperator || err == errmsg.InvalidOperand:
+		log.Infof("collapse '%s' failed: %v\n", k[1:], err)
+		return nil
+	case err != nil:
+		return err
+	}
+	tx.read(string(k), ts)
+	if err := tx.In(mvcc.Namespace{Tag: k[0]}).Set(k[1:], v); err != nil { // the value does not expire
+		return err
+	}
+	if err := tx.Commit(); err != nil && !errmsg.IsConflict(err) {
+		return err
+	}
+	return nil
+}
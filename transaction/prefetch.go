@@ -0,0 +1,201 @@
+package transaction
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/infinivision/gaeadb/constant"
+	"github.com/infinivision/gaeadb/data"
+	"github.com/infinivision/gaeadb/errmsg"
+	"github.com/infinivision/gaeadb/mvcc"
+)
+
+func newReadahead(n int) *readahead {
+	if n <= 0 {
+		n = constant.MaxLoadDataSize
+	}
+	return &readahead{n: n, avg: 32}
+}
+
+// coalesce reads the values at os sorted by offset and calls f with the index and
+// the value of each, the value of a key with expiry time still holds it. The values
+// within ra.n bytes are read by a single read, a value which is not read entirely
+// is read alone. The first error is returned after the other values are read.
+func (tx *transaction) coalesce(ra *readahead, os []uint64, f func(int, []byte)) error {
+	var rerr error
+
+	for i := 0; i < len(os); {
+		min := os[i] &^ data.ExpireMark
+		j := i + 1
+		for ; j < len(os) && int(os[j]&^data.ExpireMark-min)+ra.avg <= ra.n; j++ {
+		}
+		buf, err := tx.d.Load(min, int(os[j-1]&^data.ExpireMark-min)+data.HeaderSize+ra.avg)
+		if err != nil {
+			tx.log.Errorf("transaction - failed to preLoad: %v\n", err)
+		}
+		for ; i < j; i++ {
+			o := os[i] &^ data.ExpireMark
+			v, ok := slice(buf, int(o-min))
+			if !ok {
+				if v, err = tx.d.Read(o); err != nil {
+					if rerr == nil {
+						rerr = err
+					}
+					continue
+				}
+			}
+			ra.avg = (3*ra.avg + len(v) + data.HeaderSize) / 4
+			f(i, v)
+		}
+	}
+	return rerr
+}
+
+// slice returns the value at o of a preloaded buffer if it is loaded entirely
+func slice(buf []byte, o int) ([]byte, bool) {
+	if o+data.HeaderSize > len(buf) {
+		return nil, false
+	}
+	n := int(binary.LittleEndian.Uint16(buf[o:]))
+	if n == data.Extended || len(buf[o+data.HeaderSize:]) < n {
+		return nil, false
+	}
+	return buf[o+data.HeaderSize : o+data.HeaderSize+n], true
+}
+
+// readable reports whether o is the offset of a value in the data file
+// which is not a merge operand
+func readable(o uint64) bool {
+	return o > constant.Cache && o&(data.InlineMark|data.MergeMark) == 0
+}
+
+// newPrefetcher reads itr ahead by batches of n keys, their values are read as well unless ko.
+func (tx *transaction) newPrefetcher(itr mvcc.Iterator, n int, ra *readahead, ko bool) (*prefetcher, error) {
+	p := &prefetcher{
+		itr:  itr,
+		ch:   make(chan *batch),
+		done: make(chan struct{}),
+		fin:  make(chan struct{}),
+	}
+	go p.run(tx, n, ra, ko)
+	if err := p.advance(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *prefetcher) Close() error {
+	close(p.done)
+	<-p.fin
+	return p.itr.Close()
+}
+
+func (p *prefetcher) Next() error {
+	if p.i++; p.i < len(p.es) {
+		return nil
+	}
+	return p.advance()
+}
+
+func (p *prefetcher) Valid() bool {
+	return p.i < len(p.es)
+}
+
+func (p *prefetcher) Key() []byte {
+	return p.es[p.i].k
+}
+
+func (p *prefetcher) Value() uint64 {
+	return p.es[p.i].o
+}
+
+func (p *prefetcher) Timestamp() uint64 {
+	return p.es[p.i].ts
+}
+
+// advance waits for the next batch
+func (p *prefetcher) advance() error {
+	p.i, p.es = 0, nil
+	if b, ok := <-p.ch; ok {
+		p.es = b.es
+		return b.err
+	}
+	return nil
+}
+
+func (p *prefetcher) run(tx *transaction, n int, ra *readahead, ko bool) {
+	defer close(p.fin)
+	defer close(p.ch)
+	for p.itr.Valid() {
+		b := &batch{}
+		for len(b.es) < n && p.itr.Valid() {
+			b.es = append(b.es, &ahead{
+				k:  append([]byte{}, p.itr.Key()...),
+				o:  p.itr.Value(),
+				ts: p.itr.Timestamp(),
+			})
+			if err := p.itr.Next(); err != nil && err != errmsg.ScanEnd {
+				b.err = err
+				break
+			}
+		}
+		if !ko && b.err == nil {
+			b.err = tx.preload(ra, b.es)
+		}
+		select {
+		case p.ch <- b:
+		case <-p.done:
+			return
+		}
+		if b.err != nil {
+			return
+		}
+	}
+}
+
+// preload reads the values of es
+func (tx *transaction) preload(ra *readahead, es []*ahead) error {
+	var xs []*ahead
+
+	for _, e := range es {
+		if readable(e.o) {
+			xs = append(xs, e)
+		}
+	}
+	sort.Slice(xs, func(i, j int) bool { return xs[i].o&^data.ExpireMark < xs[j].o&^data.ExpireMark })
+	os := make([]uint64, len(xs))
+	for i, e := range xs {
+		os[i] = e.o
+	}
+	return tx.coalesce(ra, os, func(i int, v []byte) {
+		xs[i].v, xs[i].ok = v, true
+	})
+}
+
+// prefetched returns the value o of the current key of itr and whether it has not expired,
+// the value read ahead by a prefetcher is used if there is one.
+func (tx *transaction) prefetched(itr mvcc.Iterator, o uint64) ([]byte, bool, error) {
+	p, ok := itr.(*prefetcher)
+	if !ok || !p.es[p.i].ok {
+		return tx.load(o)
+	}
+	v := p.es[p.i].v
+	if o&data.ExpireMark == 0 {
+		return v, true, nil
+	}
+	dl, v, err := data.Expiry(v)
+	if err != nil {
+		return nil, false, err
+	}
+	return v, dl > time.Now().UnixNano(), nil
+}
+
+// peek returns the value of the current key of itr if it is read ahead
+func peek(itr mvcc.Iterator) ([]byte, bool) {
+	if p, ok := itr.(*prefetcher); ok && p.es[p.i].ok {
+		return p.es[p.i].v, true
+	}
+	return nil, false
+}
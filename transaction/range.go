@@ -0,0 +1,43 @@
+package transaction
+
+import (
+	"bytes"
+
+	"github.com/infinivision/gaeadb/constant"
+	"github.com/infinivision/gaeadb/data"
+	"github.com/infinivision/gaeadb/errmsg"
+	"github.com/infinivision/gaeadb/locker"
+	"github.com/infinivision/gaeadb/mvcc"
+	"github.com/infinivision/gaeadb/scheduler"
+	"github.com/infinivision/gaeadb/wal"
+	"github.com/nnsgmsone/damrey/logger"
+)
+
+// DeleteRange deletes the keys of the namespace ns from start up to end by a transaction, a nil end is
+// unbounded. The deletion is logged as one record and the snapshots older than it still see the keys,
+// the deletions older than every live snapshot are settled after it.
+func DeleteRange(ns mvcc.Namespace, start, end []byte, d data.Data, m mvcc.Space, w wal.Writer, lt locker.KeyTable, log logger.Log, schd scheduler.Scheduler) error {
+	switch {
+	case len(start) > constant.MaxKeySize || len(end) > constant.MaxKeySize:
+		return errmsg.KeyTooLong
+	case len(end) > 0 && bytes.Compare(start, end) >= 0:
+		return nil
+	}
+	tx := New(false, false, Serializable, d, m, w, lt, log, schd, nil).In(ns)
+	defer tx.Rollback()
+	tx.er = &erasure{tx.key(start), nil}
+	if len(end) > 0 {
+		tx.er.end = tx.key(end)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	ts, err := schd.Oldest()
+	if err == nil {
+		err = m.Prune(ts)
+	}
+	if err != nil { // the deletion is committed
+		log.Errorf("prune range deletions failed: %v\n", err)
+	}
+	return nil
+}
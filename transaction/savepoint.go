@@ -0,0 +1,84 @@
+package transaction
+
+import (
+	"github.com/infinivision/gaeadb/errmsg"
+)
+
+// Savepoint marks the current state of the transaction and returns its id.
+func (tx *transaction) Savepoint() int {
+	tx.spn++
+	tx.sps = append(tx.sps, &savepoint{
+		id:  tx.spn,
+		s:   tx.s,
+		n:   len(tx.ul),
+		rgs: len(tx.rgs),
+	})
+	return tx.spn
+}
+
+// RollbackTo undoes the writes and reads made after the savepoint sp,
+// sp stays valid while the savepoints created after it are released.
+// Key locks acquired after sp are kept until the transaction ends.
+func (tx *transaction) RollbackTo(sp int) error {
+	i := tx.savepoint(sp)
+	if i < 0 {
+		return errmsg.InvalidSavepoint
+	}
+	p := tx.sps[i]
+	for j := len(tx.ul) - 1; j >= p.n; j-- {
+		u := tx.ul[j]
+		switch {
+		case u.typ == W:
+			tx.restore(u)
+		case u.typ == R && u.ok:
+			tx.rmp[u.k] = u.ts
+		case u.typ == R:
+			delete(tx.rmp, u.k)
+		case u.typ == L:
+			delete(tx.lmp, u.k)
+		}
+	}
+	tx.s = p.s
+	tx.ul = tx.ul[:p.n]
+	tx.rgs = tx.rgs[:p.rgs]
+	tx.sps = tx.sps[:i+1]
+	return nil
+}
+
+// Release discards the savepoint sp and the savepoints created after it.
+func (tx *transaction) Release(sp int) error {
+	i := tx.savepoint(sp)
+	if i < 0 {
+		return errmsg.InvalidSavepoint
+	}
+	if tx.sps = tx.sps[:i]; len(tx.sps) == 0 {
+		tx.ul = nil
+	}
+	return nil
+}
+
+func (tx *transaction) savepoint(sp int) int {
+	for i := len(tx.sps) - 1; i >= 0; i-- {
+		if tx.sps[i].id == sp {
+			return i
+		}
+	}
+	return -1
+}
+
+func (tx *transaction) read(k string, ts uint64) {
+	if len(tx.sps) > 0 {
+		v, ok := tx.rmp[k]
+		tx.ul = append(tx.ul, &undo{typ: R, k: k, ok: ok, ts: v})
+	}
+	tx.rmp[k] = ts
+}
+
+func (tx *transaction) locked(k string) {
+	if _, ok := tx.lmp[k]; !ok {
+		if len(tx.sps) > 0 {
+			tx.ul = append(tx.ul, &undo{typ: L, k: k})
+		}
+		tx.lmp[k] = struct{}{}
+	}
+}
@@ -0,0 +1,191 @@
+package transaction
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/infinivision/gaeadb/constant"
+	"github.com/infinivision/gaeadb/data"
+)
+
+// write adds k to the write set, the values written after the transaction
+// grows beyond constant.SpillSize are kept in a temporary file.
+// A value expires at dl unless dl is zero, and is a merge operand if mg is true.
+func (tx *transaction) write(k string, v []byte, dl int64, mg bool) error {
+	if len(tx.sps) > 0 {
+		u, ok := tx.wmp.Get(k)
+		tx.ul = append(tx.ul, &undo{typ: W, k: k, ok: ok, v: u, e: tx.sp.extent(k), dl: tx.dmp[k], mg: tx.mmp[k]})
+	}
+	switch {
+	case dl != 0:
+		tx.dmp[k] = dl
+	default:
+		delete(tx.dmp, k)
+	}
+	switch {
+	case mg:
+		tx.mmp[k] = true
+	default:
+		delete(tx.mmp, k)
+	}
+	if len(v) > 0 && tx.s > constant.SpillSize {
+		if tx.sp == nil {
+			sp, err := newSpill()
+			if err != nil {
+				return err
+			}
+			tx.sp = sp
+		}
+		e, err := tx.sp.write(v)
+		if err != nil {
+			return err
+		}
+		tx.sp.mp[k] = e
+		tx.wmp.Set(k, []byte{}) // placeholder
+		return nil
+	}
+	tx.sp.del(k)
+	tx.wmp.Set(k, v)
+	return nil
+}
+
+// restore undoes a write of k
+func (tx *transaction) restore(u *undo) {
+	switch {
+	case u.ok:
+		tx.wmp.Set(u.k, u.v)
+	default:
+		tx.wmp.Del(u.k)
+	}
+	switch {
+	case u.e != nil:
+		tx.sp.mp[u.k] = u.e
+	default:
+		tx.sp.del(u.k)
+	}
+	switch {
+	case u.dl != 0:
+		tx.dmp[u.k] = u.dl
+	default:
+		delete(tx.dmp, u.k)
+	}
+	switch {
+	case u.mg:
+		tx.mmp[u.k] = true
+	default:
+		delete(tx.mmp, u.k)
+	}
+}
+
+// get returns the value of k in the write set, an expired value reads as deleted
+// and a merge operand is combined with the value of k in the snapshot.
+func (tx *transaction) get(k string) ([]byte, bool, error) {
+	if tx.lapsed(k) {
+		return nil, true, nil
+	}
+	v, ok, err := tx.pending(k)
+	if ok && err == nil && tx.mmp[k] {
+		v, err = tx.merged(k, v)
+	}
+	return v, ok, err
+}
+
+// lapsed reports whether the value of k in the write set has expired
+func (tx *transaction) lapsed(k string) bool {
+	dl, ok := tx.dmp[k]
+	return ok && dl <= time.Now().UnixNano()
+}
+
+func (tx *transaction) pending(k string) ([]byte, bool, error) {
+	v, ok := tx.wmp.Get(k)
+	if e := tx.sp.extent(k); ok && e != nil {
+		v, err := tx.sp.read(e)
+		return v, true, err
+	}
+	return v, ok, nil
+}
+
+// value returns the value of k in the write set during commit
+func (tx *transaction) value(k string) []byte {
+	v, _, err := tx.pending(k)
+	if err != nil {
+		tx.log.Fatalf("transaction read spilled value of '%s' failed: %v\n", k, err)
+	}
+	return v
+}
+
+func newSpill() (*spill, error) {
+	fp, err := ioutil.TempFile("", "gaeadb")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(fp.Name()) // the space is freed once the file is closed
+	return &spill{fp: fp, mp: make(map[string]*extent)}, nil
+}
+
+func (sp *spill) close() {
+	if sp != nil {
+		sp.fp.Close()
+	}
+}
+
+func (sp *spill) extent(k string) *extent {
+	if sp == nil {
+		return nil
+	}
+	return sp.mp[k]
+}
+
+func (sp *spill) del(k string) {
+	if sp != nil {
+		delete(sp.mp, k)
+	}
+}
+
+func (sp *spill) write(v []byte) (*extent, error) {
+	if _, err := sp.fp.WriteAt(v, sp.n); err != nil {
+		return nil, err
+	}
+	e := &extent{o: sp.n, n: len(v)}
+	sp.n += int64(len(v))
+	return e, nil
+}
+
+func (sp *spill) read(e *extent) ([]byte, error) {
+	v := make([]byte, e.n)
+	if _, err := sp.fp.ReadAt(v, e.o); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// place returns the index value of k written as v during commit,
+// a value kept in the data file is written to space appended to os.
+func (tx *transaction) place(k string, v []byte, os *[]uint64) uint64 {
+	var mark uint64
+
+	dl, ok := tx.dmp[k]
+	switch {
+	case ok:
+		v, mark = data.Expire(v, dl), data.ExpireMark
+	case tx.mmp[k]:
+		mark = data.MergeMark
+	case v == nil:
+		return constant.Delete
+	case len(v) == 0:
+		return constant.Empty
+	case len(v) <= data.MaxInlineSize:
+		o, _ := data.Inline(v)
+		return o
+	}
+	o, err := tx.d.Alloc(v)
+	if err != nil {
+		tx.log.Fatalf("transaction alloc space for data failed: %v\n", err)
+	}
+	if err := tx.d.Write(o, v); err != nil {
+		tx.log.Fatalf("transaction write data of '%s' failed: %v\n", k[1:], err)
+	}
+	*os = append(*os, o)
+	return o | mark
+}
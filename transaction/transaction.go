@@ -1,45 +1,112 @@
 package transaction
 
 import (
+	"bytes"
 	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"runtime"
 	"sync/atomic"
+	"time"
 
-	"github.com/infinivision/gaeadb/cache"
 	"github.com/infinivision/gaeadb/constant"
 	"github.com/infinivision/gaeadb/data"
 	"github.com/infinivision/gaeadb/errmsg"
+	"github.com/infinivision/gaeadb/locker"
+	"github.com/infinivision/gaeadb/merge"
 	"github.com/infinivision/gaeadb/mvcc"
 	"github.com/infinivision/gaeadb/scheduler"
+	"github.com/infinivision/gaeadb/skiplist"
 	"github.com/infinivision/gaeadb/wal"
 	"github.com/nnsgmsone/damrey/logger"
 )
 
-func New(ro bool, d data.Data, m mvcc.MVCC, w wal.Writer, log logger.Log, schd scheduler.Scheduler) *transaction {
-	return &transaction{
+func New(ro, pes bool, lvl Isolation, d data.Data, m mvcc.Space, w wal.Writer, lt locker.KeyTable, log logger.Log, schd scheduler.Scheduler, ops merge.Operators) *transaction {
+	id, ts := schd.Start()
+	return newTransaction(ro, pes, lvl, id, ts, d, m, w, lt, log, schd, ops)
+}
+
+// NewAt creates a transaction which reads at the timestamp supplied by application.
+func NewAt(ro bool, lvl Isolation, ts uint64, d data.Data, m mvcc.Space, w wal.Writer, lt locker.KeyTable, log logger.Log, schd scheduler.Scheduler, ops merge.Operators) (*transaction, error) {
+	id, err := schd.StartAt(ts)
+	if err != nil {
+		return nil, err
+	}
+	return newTransaction(ro, false, lvl, id, ts, d, m, w, lt, log, schd, ops), nil
+}
+
+func newTransaction(ro, pes bool, lvl Isolation, id, ts uint64, d data.Data, m mvcc.Space, w wal.Writer, lt locker.KeyTable, log logger.Log, schd scheduler.Scheduler, ops merge.Operators) *transaction {
+	tx := &transaction{m.Namespaces()[0], &state{
+		id:   id,
 		s:    13, // timestamp size + one byte + key's number
 		d:    d,
 		m:    m,
 		w:    w,
 		ro:   ro,
+		pes:  pes,
+		lvl:  lvl,
+		rts:  ts,
+		lt:   lt,
 		log:  log,
 		schd: schd,
-		rts:  schd.Start(),
 		rmp:  make(map[string]uint64),
-		wmp:  make(map[string][]byte),
+		wmp:  skiplist.New(),
+		lmp:  make(map[string]struct{}),
+		ops:  ops,
+		dmp:  make(map[string]int64),
+		mmp:  make(map[string]bool),
+	}}
+	runtime.SetFinalizer(tx.state, func(st *state) {
+		if del(&st.n) < 0 { // neither committed nor rolled back
+			st.log.Infof("transaction %v reading at %v is leaked\n", st.id, st.rts)
+			st.release()
+			go st.schd.End(st.id)
+		}
+	})
+	return tx
+}
+
+// In returns the view of the transaction on the namespace ns,
+// the views of a transaction read and write in the same snapshot.
+func (tx *transaction) In(ns mvcc.Namespace) *transaction {
+	return &transaction{ns, tx.state}
+}
+
+// Namespace returns the view of the transaction on the namespace name,
+// the writes of every view are committed atomically.
+func (tx *transaction) Namespace(name string) (Transaction, error) {
+	ns, err := tx.m.Namespace(name)
+	if err != nil {
+		return nil, err
 	}
+	return tx.In(ns), nil
 }
 
 func (tx *transaction) Rollback() error {
 	if del(&tx.n) >= 0 {
 		return nil
 	}
-	return nil
+	tx.release()
+	return tx.schd.End(tx.id)
 }
 
 func (tx *transaction) Commit() error {
+	return tx.commit(0)
+}
+
+// CommitAt commits the transaction with the timestamp supplied by application,
+// the timestamp must be greater than any timestamp used before and below mvcc.Long.
+func (tx *transaction) CommitAt(ts uint64) error {
+	if ts == 0 {
+		return errmsg.InvalidTimestamp
+	}
+	return tx.commit(ts)
+}
+
+func (tx *transaction) commit(ts uint64) error {
 	var err error
-	var os []uint64
-	var ks []string
+	var os, is []uint64 // data offsets and index values of the write set
 
 	switch {
 	case tx.ro:
@@ -47,98 +114,117 @@ func (tx *transaction) Commit() error {
 	case del(&tx.n) >= 0:
 		return nil
 	}
-	tx.wts, err = tx.schd.Commit(tx.rts, tx.rmp, tx.wmp)
+	defer tx.release()
+	var ms []string                       // keys written by merge operands
+	xs := make([]string, 0, tx.wmp.Len()) // in order, keeps the log and the data file identical between replicas
+	for itr := tx.wmp.NewForwardIterator(nil); itr.Valid(); itr.Next() {
+		if xs = append(xs, itr.Key()); tx.mmp[itr.Key()] {
+			ms = append(ms, itr.Key())
+		}
+	}
+	var wrs []*scheduler.Range // deleted ranges
+	if tx.er != nil {
+		wrs = append(wrs, &scheduler.Range{Open: true, Prefix: tx.er.start[:1], Start: tx.er.start, End: tx.er.end})
+	}
+	tx.wts, err = tx.schd.Commit(tx.id, int(tx.lvl), ts, tx.rmp, tx.rgs, wrs, xs, ms)
 	if err != nil {
-		return err
+		return tx.conflict(err)
 	}
-	cnt := 0
-	log := make([]byte, tx.s)
-	{ // commit
-		log[0] = wal.ST
-		binary.LittleEndian.PutUint64(log[1:], tx.wts)
-		binary.LittleEndian.PutUint32(log[9:], uint32(len(tx.wmp)))
-		i := 13
-		for k, v := range tx.wmp {
-			binary.LittleEndian.PutUint16(log[i:], uint16(len(k)))
-			i += 2
-			copy(log[i:], []byte(k))
-			i += len(k)
-			binary.LittleEndian.PutUint16(log[i:], uint16(len(v)))
-			i += 2
-			if len(v) > 0 {
-				cnt++
-				copy(log[i:], v)
-				i += len(v)
+	{ // commit, a large write set is logged by chained records
+		n, size := 0, constant.MaxRecordSize
+		if tx.s < constant.MaxRecordSize {
+			size = int(tx.s)
+		}
+		var tag byte // a record holds the keys of a namespace
+
+		log := make([]byte, 13, size)
+		for _, k := range xs {
+			v := tx.value(k)
+			if k[0] != tag || (n > 0 && len(log)+18+len(k)+len(v) > constant.MaxRecordSize) {
+				if n > 0 {
+					if err = tx.append(tx.start(tag), log, n); err != nil {
+						tx.log.Fatalf("transaction start failed: %v\n", err)
+					}
+				}
+				tag, n, log = k[0], 0, tx.header(k[0], log)
+			}
+			log = append(log, byte(len(k)-1), byte((len(k)-1)>>8))
+			log = append(log, k[1:]...)
+			if dl, ok := tx.dmp[k]; ok {
+				log = appendExpiry(log, dl)
 			}
+			if tx.mmp[k] {
+				log = append(log, 0, 0)
+				binary.LittleEndian.PutUint16(log[len(log)-2:], data.Merging)
+			}
+			log = appendLength(log, v)
+			log = append(log, v...)
+			n++
+			is = append(is, tx.place(k, v, &os))
 		}
-		if err = tx.w.Append(log); err != nil {
+		if err = tx.append(tx.start(tag), log, n); err != nil {
 			tx.log.Fatalf("transaction start failed: %v\n", err)
 		}
 	}
 	{
-		if len(log) < 9+4+cnt*8 {
-			log = make([]byte, 9+4+cnt*8)
-		} else {
-			log = log[:9+4+cnt*8]
+		n := 0
+		log := make([]byte, 13, 13+8*len(os))
+		for _, o := range os {
+			if len(log)+8 > constant.MaxRecordSize {
+				if err = tx.append(wal.WD, log, n); err != nil {
+					tx.log.Fatalf("transaction append record failed: %v\n", err)
+				}
+				n, log = 0, log[:13]
+			}
+			log = append(log, make([]byte, 8)...)
+			binary.LittleEndian.PutUint64(log[len(log)-8:], o)
+			n++
 		}
-		log[0] = wal.WD
+		if err = tx.append(wal.WD, log, n); err != nil {
+			tx.log.Fatalf("transaction append record failed: %v\n", err)
+		}
+	}
+	if tx.er != nil {
+		start, end := tx.er.start[1:], untag(tx.er.end)
+		log := make([]byte, 9, 270+len(start)+len(end))
+		log[0] = wal.DR
 		binary.LittleEndian.PutUint64(log[1:], tx.wts)
-		binary.LittleEndian.PutUint32(log[9:], uint32(cnt))
-		i := 13
-		for k, v := range tx.wmp {
-			switch {
-			case v == nil:
-				continue
-			case len(v) == 0:
-				ks = append(ks, k)
-				continue
-			}
-			if o, err := tx.d.Alloc(v); err != nil {
-				tx.log.Fatalf("transaction alloc space for data failed: %v\n", err)
-			} else {
-				os = append(os, o)
-				binary.LittleEndian.PutUint64(log[i:], o)
-				i += 8
-			}
-			ks = append(ks, k)
+		if tag := tx.er.start[0]; tag != 0 {
+			log[0] = wal.NR
+			log = append(log, byte(len(tx.m.Namespaces()[tag].Name)))
+			log = append(log, tx.m.Namespaces()[tag].Name...)
 		}
+		log = append(log, byte(len(start)), byte(len(start)>>8))
+		log = append(log, start...)
+		log = append(log, byte(len(end)), byte(len(end)>>8))
+		log = append(log, end...)
 		if err = tx.w.Append(log); err != nil {
-			tx.log.Fatalf("transaction append record failed: %v\n", err)
+			tx.log.Fatalf("transaction delete range failed: %v\n", err)
 		}
 	}
 	w := &walWriter{
 		w:  tx.w,
 		ts: tx.wts,
-		mp: make(map[int64]cache.Page),
+		mp: make(map[int64]*page),
 	}
-	for _, k := range ks {
-		switch {
-		case tx.wmp[k] == nil:
-			if err := tx.m.Set([]byte(k), constant.Delete, tx.wts, w); err != nil {
-				tx.log.Fatalf("transaction del '%s' failed: %v\n", k, err)
-			}
-		case len(tx.wmp[k]) == 0:
-			if err := tx.m.Set([]byte(k), constant.Empty, tx.wts, w); err != nil {
-				tx.log.Fatalf("transaction set '%s' failed: %v\n", k, err)
-			}
-		default:
-			if err := tx.d.Write(os[0], tx.wmp[k]); err != nil {
-				tx.log.Fatalf("transaction write data of '%s' failed: %v\n", k, err)
-			}
-			if err := tx.m.Set([]byte(k), os[0], tx.wts, w); err != nil {
-				tx.log.Fatalf("transaction set '%s' failed: %v\n", k, err)
-			}
-			os = os[1:]
+	for i, k := range xs {
+		if err := tx.m.Set([]byte(k), is[i], tx.wts, w); err != nil {
+			tx.log.Fatalf("transaction set '%s' failed: %v\n", k[1:], err)
 		}
 	}
 	{
-		log = log[:9]
+		log := make([]byte, 9)
 		log[0] = wal.CT
 		binary.LittleEndian.PutUint64(log[1:], tx.wts)
 		if err = tx.w.Append(log); err != nil {
 			tx.log.Fatalf("transaction commit failed: %v\n", err)
 		}
 	}
+	if tx.er != nil { // kept only once committed, recovery replays the record otherwise
+		if err := tx.m.DelRange(tx.er.start, tx.er.end, tx.wts); err != nil {
+			tx.log.Fatalf("transaction delete range failed: %v\n", err)
+		}
+	}
 	{
 		for _, pg := range w.mp {
 			if pg.s {
@@ -152,6 +238,81 @@ func (tx *transaction) Commit() error {
 	return nil
 }
 
+// append logs a record of typ holding n entries of the write set.
+func (tx *transaction) append(typ byte, log []byte, n int) error {
+	log[0] = typ
+	binary.LittleEndian.PutUint64(log[1:], tx.wts)
+	binary.LittleEndian.PutUint32(log[9:], uint32(n))
+	return tx.w.Append(log)
+}
+
+// start returns the type of the start records of the namespace of tag
+func (tx *transaction) start(tag byte) byte {
+	if tag == 0 {
+		return wal.ST
+	}
+	return wal.NT
+}
+
+// header truncates log to the header of a start record of the namespace of tag.
+func (tx *transaction) header(tag byte, log []byte) []byte {
+	if log = log[:13]; tag == 0 {
+		return log
+	}
+	name := tx.m.Namespaces()[tag].Name
+	log = append(log, byte(len(name)))
+	return append(log, name...)
+}
+
+// key returns k tagged by the namespace of the transaction
+func (tx *transaction) key(k []byte) []byte {
+	return append([]byte{tx.ns.Tag}, k...)
+}
+
+// conflict strips the namespace tag from the key of a conflict error
+func (tx *transaction) conflict(err error) error {
+	e, ok := err.(*errmsg.ConflictError)
+	if !ok || len(e.Key) == 0 {
+		return err
+	}
+	return &errmsg.ConflictError{Key: e.Key[1:], Namespace: tx.m.Namespaces()[e.Key[0]].Name}
+}
+
+// untag returns the key k without its tag, an empty key is unbounded.
+func untag(k []byte) []byte {
+	if len(k) == 0 {
+		return nil
+	}
+	return k[1:]
+}
+
+// appendExpiry marks the next value of a start record as expiring at dl.
+func appendExpiry(log []byte, dl int64) []byte {
+	log = append(log, make([]byte, 10)...)
+	binary.LittleEndian.PutUint16(log[len(log)-10:], data.Expiring)
+	binary.LittleEndian.PutUint64(log[len(log)-8:], uint64(dl))
+	return log
+}
+
+// appendLength appends the length of v to a start record, an empty value is logged as
+// data.Empty since a length of zero is a deletion, a length of at least 64KB follows the
+// data.Extended mark.
+func appendLength(log []byte, v []byte) []byte {
+	n := len(v)
+	switch {
+	case v != nil && n == 0:
+		log = append(log, 0, 0)
+		binary.LittleEndian.PutUint16(log[len(log)-2:], data.Empty)
+		return log
+	case n < data.Empty:
+		return append(log, byte(n), byte(n>>8))
+	}
+	log = append(log, make([]byte, 6)...)
+	binary.LittleEndian.PutUint16(log[len(log)-6:], data.Extended)
+	binary.LittleEndian.PutUint32(log[len(log)-4:], uint32(n))
+	return log
+}
+
 func (tx *transaction) Del(k []byte) error {
 	switch {
 	case tx.ro:
@@ -161,14 +322,36 @@ func (tx *transaction) Del(k []byte) error {
 	case len(k) > constant.MaxKeySize:
 		return errmsg.KeyTooLong
 	}
-	if tx.s += 4 + len(k); tx.s > constant.MaxTransactionSize {
+	k = tx.key(k)
+	if _, ok := tx.lmp[string(k)]; tx.pes && !ok {
+		if _, err := tx.lock(k); err != nil {
+			return err
+		}
+	}
+	if tx.s += 3 + int64(len(k)); tx.s > constant.MaxTransactionSize {
 		return errmsg.OutOfSpace
 	}
-	tx.wmp[string(k)] = nil
-	return nil
+	return tx.write(string(k), nil, 0, false)
 }
 
+// Set sets the value of k, which expires after the TTL of the namespace if it has one.
 func (tx *transaction) Set(k, v []byte) error {
+	if tx.ns.TTL > 0 {
+		return tx.set(k, v, time.Now().Add(tx.ns.TTL).UnixNano())
+	}
+	return tx.set(k, v, 0)
+}
+
+// SetWithTTL sets the value of k which expires after ttl,
+// an expired key reads as deleted until it is swept.
+func (tx *transaction) SetWithTTL(k, v []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errmsg.InvalidTTL
+	}
+	return tx.set(k, v, time.Now().Add(ttl).UnixNano())
+}
+
+func (tx *transaction) set(k, v []byte, dl int64) error {
 	switch {
 	case tx.ro:
 		return errmsg.ReadOnlyTransaction
@@ -179,76 +362,355 @@ func (tx *transaction) Set(k, v []byte) error {
 	case len(v) > constant.MaxValueSize:
 		return errmsg.ValTooLong
 	}
-	if tx.s += 4 + len(k) + len(v); tx.s > constant.MaxTransactionSize {
+	k = tx.key(k)
+	if _, ok := tx.lmp[string(k)]; tx.pes && !ok {
+		if _, err := tx.lock(k); err != nil {
+			return err
+		}
+	}
+	if tx.s += 3 + int64(len(k)+len(v)); tx.s > constant.MaxTransactionSize {
 		return errmsg.OutOfSpace
 	}
-	tx.wmp[string(k)] = v
-	return nil
+	if dl != 0 {
+		tx.s += 10
+	}
+	return tx.write(string(k), v, dl, false)
 }
 
 func (tx *transaction) Get(k []byte) ([]byte, error) {
+	v, _, err := tx.GetVersion(k)
+	return v, err
+}
+
+// GetVersion returns the value of k and the commit timestamp of its version,
+// the timestamp of a value written by the transaction itself is zero.
+func (tx *transaction) GetVersion(k []byte) ([]byte, uint64, error) {
+	v, o, ts, err := tx.lookup(k)
+	if err != nil || o == constant.Cancel {
+		return v, ts, err
+	}
+	if v, ok, err := tx.load(o); err != nil || ok {
+		return v, ts, err
+	}
+	return nil, 0, errmsg.NotExist
+}
+
+// GetReader returns a reader of the value of k, a committed value
+// is read from the data file on demand instead of being loaded at once.
+func (tx *transaction) GetReader(k []byte) (io.Reader, error) {
+	v, o, _, err := tx.lookup(k)
+	switch {
+	case err != nil:
+		return nil, err
+	case o == constant.Cancel:
+		return bytes.NewReader(v), nil
+	}
+	r, err := tx.d.NewReader(o &^ data.ExpireMark)
+	if err == nil && o&data.ExpireMark != 0 {
+		_, err = io.CopyN(ioutil.Discard, r, 8)
+	}
+	return r, err
+}
+
+// lookup returns either the value of k or the offset of its value in the data file,
+// and the timestamp of its version which is zero for a pending write.
+func (tx *transaction) lookup(k []byte) ([]byte, uint64, uint64, error) {
 	if len(k) == 0 {
-		return nil, errmsg.KeyIsEmpty
+		return nil, constant.Cancel, 0, errmsg.KeyIsEmpty
 	}
+	k = tx.key(k)
 	if !tx.ro {
-		if v, ok := tx.wmp[string(k)]; ok {
-			if v == nil {
-				return nil, errmsg.NotExist
+		if v, ok, err := tx.get(string(k)); ok {
+			switch {
+			case err != nil:
+				return nil, constant.Cancel, 0, err
+			case v == nil:
+				return nil, constant.Cancel, 0, errmsg.NotExist
 			}
-			return v, nil
+			return v, constant.Cancel, 0, nil
 		}
 	}
 	o, ts, err := tx.m.Get(k, tx.rts)
+	switch {
+	case err == errmsg.NotExist || (err == nil && o == constant.Delete):
+		if !tx.ro { // the absence is read at the snapshot
+			tx.read(string(k), tx.rts)
+		}
+		return nil, constant.Cancel, 0, errmsg.NotExist
+	case err != nil:
+		return nil, constant.Cancel, 0, err
+	}
+	if !tx.ro {
+		tx.read(string(k), ts)
+	}
+	if o&data.MergeMark != 0 {
+		v, _, err := tx.resolve(k, tx.rts)
+		if err != nil {
+			return nil, constant.Cancel, 0, err
+		}
+		return v, constant.Cancel, ts, nil
+	}
+	if o == constant.Empty {
+		return []byte{}, constant.Cancel, ts, nil
+	}
+	if v, ok := data.Inlined(o); ok {
+		return v, constant.Cancel, ts, nil
+	}
+	if ok, err := tx.expired(o); err != nil {
+		return nil, constant.Cancel, 0, err
+	} else if ok {
+		return nil, constant.Cancel, 0, errmsg.NotExist
+	}
+	return nil, o, ts, nil
+}
+
+// expired reports whether the value at o has expired
+func (tx *transaction) expired(o uint64) (bool, error) {
+	if o&data.ExpireMark == 0 {
+		return false, nil
+	}
+	r, err := tx.d.NewReader(o &^ data.ExpireMark)
+	if err != nil {
+		return false, err
+	}
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return false, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)) <= time.Now().UnixNano(), nil
+}
+
+// load reads the value at o, it returns false if the value has expired
+func (tx *transaction) load(o uint64) ([]byte, bool, error) {
+	v, err := tx.d.Read(o &^ data.ExpireMark)
+	if err != nil || o&data.ExpireMark == 0 {
+		return v, err == nil, err
+	}
+	dl, v, err := data.Expiry(v)
 	if err != nil {
+		return nil, false, err
+	}
+	return v, dl > time.Now().UnixNano(), nil
+}
+
+// deferred reads the value o of k skipped by a key-only iterator
+func (tx *transaction) deferred(k []byte, o uint64) ([]byte, error) {
+	if o&data.MergeMark != 0 {
+		v, _, err := tx.resolve(k, tx.rts)
+		return v, err
+	}
+	v, ok, err := tx.load(o)
+	switch {
+	case err != nil:
 		return nil, err
+	case !ok:
+		return nil, errmsg.NotExist
 	}
+	return v, nil
+}
+
+// stored reports whether o is the offset of a value without expiry time in the data file
+func stored(o uint64) bool {
+	return o > constant.Cache && o&(data.InlineMark|data.ExpireMark|data.MergeMark) == 0
+}
+
+// Lock acquires the exclusive lock of k until the transaction ends.
+func (tx *transaction) Lock(k []byte) error {
+	switch {
+	case tx.ro:
+		return errmsg.ReadOnlyTransaction
+	case len(k) == 0:
+		return errmsg.KeyIsEmpty
+	case len(k) > constant.MaxKeySize:
+		return errmsg.KeyTooLong
+	}
+	_, err := tx.lock(tx.key(k))
+	return err
+}
+
+// GetForUpdate locks k and returns its latest committed value
+// instead of the value in the snapshot of the transaction.
+func (tx *transaction) GetForUpdate(k []byte) ([]byte, error) {
 	switch {
-	case o != constant.Empty:
-		if v, err := tx.d.Read(o); err != nil {
+	case tx.ro:
+		return nil, errmsg.ReadOnlyTransaction
+	case len(k) == 0:
+		return nil, errmsg.KeyIsEmpty
+	case len(k) > constant.MaxKeySize:
+		return nil, errmsg.KeyTooLong
+	}
+	k = tx.key(k)
+	o, err := tx.lock(k)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok, err := tx.get(string(k)); ok {
+		switch {
+		case err != nil:
 			return nil, err
-		} else {
-			if !tx.ro {
-				tx.rmp[string(k)] = ts
-			}
-			return v, nil
-		}
-	default:
-		if !tx.ro {
-			tx.rmp[string(k)] = ts
+		case v == nil:
+			return nil, errmsg.NotExist
 		}
+		return v, nil
+	}
+	switch o {
+	case constant.Delete:
+		return nil, errmsg.NotExist
+	case constant.Empty:
 		return []byte{}, nil
 	}
+	if o&data.MergeMark != 0 {
+		v, _, err := tx.resolve(k, math.MaxUint64)
+		return v, err
+	}
+	if v, ok := data.Inlined(o); ok {
+		return v, nil
+	}
+	if v, ok, err := tx.load(o); err != nil || ok {
+		return v, err
+	}
+	return nil, errmsg.NotExist
 }
 
 func (tx *transaction) NewForwardIterator(pref []byte) (Iterator, error) {
-	if itr, err := tx.m.NewForwardIterator(pref, tx.rts); err != nil {
+	return tx.newForwardIterator(pref, IteratorOptions{})
+}
+
+// NewForwardKeyIterator iterates the keys without reading their values
+// from the data file, the value of the current key is read by Value.
+func (tx *transaction) NewForwardKeyIterator(pref []byte) (Iterator, error) {
+	return tx.newForwardIterator(pref, IteratorOptions{KeysOnly: true})
+}
+
+func (tx *transaction) newForwardIterator(pref []byte, opt IteratorOptions) (Iterator, error) {
+	pref = tx.key(pref)
+	r := tx.scan(pref)
+	itr, err := tx.m.NewForwardIterator(pref, tx.rts)
+	if err != nil && err != errmsg.ScanEnd {
+		return nil, err
+	}
+	if itr, err = tx.readAhead(itr, &opt); err != nil {
 		return nil, err
-	} else {
-		fitr := &forwardIterator{
-			tx:  tx,
-			itr: itr,
-			kv: &kvList{
-				mp:  make(map[string][]byte),
-				omp: make(map[string]uint64),
-			},
-		}
-		return fitr, fitr.seek()
 	}
+	if r != nil {
+		r.End = pref // nothing is scanned yet
+	}
+	fitr := &forwardIterator{
+		opt:  opt,
+		pref: pref,
+		ra:   newReadahead(opt.BatchBytes),
+		r:    r,
+		tx:   tx,
+		itr:  itr,
+		wi:   tx.wmp.NewForwardIterator(pref),
+		kv: &kvList{
+			mp:  make(map[string][]byte),
+			omp: make(map[string]uint64),
+		},
+	}
+	if err := fitr.seek(); err != nil {
+		fitr.Close()
+		return nil, err
+	}
+	return fitr, nil
 }
 
 func (tx *transaction) NewBackwardIterator(pref []byte) (Iterator, error) {
-	if itr, err := tx.m.NewBackwardIterator(pref, tx.rts); err != nil {
+	return tx.newBackwardIterator(pref, IteratorOptions{})
+}
+
+// NewBackwardKeyIterator is NewForwardKeyIterator in reverse order.
+func (tx *transaction) NewBackwardKeyIterator(pref []byte) (Iterator, error) {
+	return tx.newBackwardIterator(pref, IteratorOptions{KeysOnly: true})
+}
+
+func (tx *transaction) newBackwardIterator(pref []byte, opt IteratorOptions) (Iterator, error) {
+	pref = tx.key(pref)
+	r := tx.scan(pref)
+	itr, err := tx.m.NewBackwardIterator(pref, tx.rts)
+	if err != nil && err != errmsg.ScanEnd {
 		return nil, err
-	} else {
-		bitr := &forwardIterator{
-			tx:  tx,
-			itr: itr,
-			kv: &kvList{
-				mp:  make(map[string][]byte),
-				omp: make(map[string]uint64),
-			},
-		}
-		return bitr, bitr.seek()
+	}
+	if itr, err = tx.readAhead(itr, &opt); err != nil {
+		return nil, err
+	}
+	bitr := &backwardIterator{
+		opt:  opt,
+		pref: pref,
+		ra:   newReadahead(opt.BatchBytes),
+		r:    r,
+		tx:   tx,
+		itr:  itr,
+		wi:   tx.wmp.NewBackwardIterator(pref),
+		kv: &kvList{
+			mp:  make(map[string][]byte),
+			omp: make(map[string]uint64),
+		},
+	}
+	if err := bitr.seek(); err != nil {
+		bitr.Close()
+		return nil, err
+	}
+	return bitr, nil
+}
+
+// NewIterator creates an iterator tuned by opt.
+func (tx *transaction) NewIterator(pref []byte, opt IteratorOptions) (Iterator, error) {
+	if opt.Reverse {
+		return tx.newBackwardIterator(pref, opt)
+	}
+	return tx.newForwardIterator(pref, opt)
+}
+
+// readAhead fills the defaults of opt and reads itr ahead in the background if opt asks to.
+func (tx *transaction) readAhead(itr mvcc.Iterator, opt *IteratorOptions) (mvcc.Iterator, error) {
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = constant.PreLoad
+	}
+	if itr == nil || !opt.Prefetch {
+		return itr, nil
+	}
+	p, err := tx.newPrefetcher(itr, opt.BatchSize, newReadahead(opt.BatchBytes), opt.KeysOnly)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// scan records a range read for phantom detection, the whole prefix
+// is covered until the iterator narrows it.
+func (tx *transaction) scan(pref []byte) *scheduler.Range {
+	if tx.ro {
+		return nil
+	}
+	r := &scheduler.Range{Prefix: append([]byte{}, pref...)}
+	tx.rgs = append(tx.rgs, r)
+	return r
+}
+
+// lock acquires the lock of k and reads the latest committed version,
+// later writes of k are validated against that version.
+func (tx *transaction) lock(k []byte) (uint64, error) {
+	tx.lk = true
+	if err := tx.lt.Lock(tx.id, string(k)); err != nil {
+		return 0, err
+	}
+	o, ts, err := tx.m.Get(k, math.MaxUint64)
+	switch {
+	case err == errmsg.NotExist:
+		o, ts = constant.Delete, tx.rts
+	case err != nil:
+		return 0, err
+	}
+	tx.read(string(k), ts) // the version read under the lock replaces an earlier read
+	tx.locked(string(k))
+	return o, nil
+}
+
+func (st *state) release() {
+	st.sp.close()
+	if st.lk {
+		st.lt.Release(st.id)
 	}
 }
 
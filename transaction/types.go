@@ -2,23 +2,100 @@ package transaction
 
 import (
 	"encoding/binary"
+	"io"
+	"os"
+	"time"
 
 	"github.com/infinivision/gaeadb/cache"
 	"github.com/infinivision/gaeadb/data"
+	"github.com/infinivision/gaeadb/locker"
+	"github.com/infinivision/gaeadb/merge"
 	"github.com/infinivision/gaeadb/mvcc"
 	"github.com/infinivision/gaeadb/scheduler"
+	"github.com/infinivision/gaeadb/skiplist"
 	"github.com/infinivision/gaeadb/wal"
 	"github.com/nnsgmsone/damrey/logger"
 )
 
+// Isolation is the isolation level of a transaction
+type Isolation int
+
+const (
+	Serializable      = Isolation(scheduler.SSI) // serializable snapshot isolation
+	SnapshotIsolation = Isolation(scheduler.SI)  // first-committer-wins, write skew is possible
+)
+
 type Transaction interface {
 	Commit() error
+	CommitAt(uint64) error
 	Rollback() error
 	Del([]byte) error
 	Set([]byte, []byte) error
+	SetWithTTL([]byte, []byte, time.Duration) error
+	Merge([]byte, []byte) error
 	Get([]byte) ([]byte, error)
+	GetVersion([]byte) ([]byte, uint64, error)
+	GetMany([][]byte) ([][]byte, error)
+	GetReader([]byte) (io.Reader, error)
+	Count([]byte) (int, error)
+	Lock([]byte) error
+	GetForUpdate([]byte) ([]byte, error)
+	Savepoint() int
+	Release(int) error
+	RollbackTo(int) error
 	NewForwardIterator([]byte) (Iterator, error)
 	NewBackwardIterator([]byte) (Iterator, error)
+	NewForwardKeyIterator([]byte) (Iterator, error)
+	NewBackwardKeyIterator([]byte) (Iterator, error)
+	NewIterator([]byte, IteratorOptions) (Iterator, error)
+	Resume([]byte) (Iterator, error)
+	Namespace(string) (Transaction, error)
+}
+
+// IteratorOptions tunes how an iterator reads ahead, the zero value
+// is the ordinary forward iterator.
+type IteratorOptions struct {
+	Reverse    bool
+	KeysOnly   bool // values are read by Value
+	Prefetch   bool // the next batch is read in the background while the current one is consumed
+	BatchSize  int  // keys read by a batch, constant.PreLoad by default
+	BatchBytes int  // bytes read by a single read of values, constant.MaxLoadDataSize by default
+	Snapshot   bool // Cursor keeps the read timestamp, a resumed scan reads the same snapshot
+}
+
+const (
+	reverse = 1 << iota // flags of a cursor
+	keysOnly
+	snapshot
+)
+
+// cursor is the position of a scan, the keys after last remain or the keys
+// before it in reverse order, a nil last is the start of the scan.
+type cursor struct {
+	ts   uint64 // read timestamp of a snapshot scan
+	opt  IteratorOptions
+	pref []byte
+	last []byte
+}
+
+// segment is a part of a resumed scan, the keys with prefix pref or pref itself.
+type segment struct {
+	exact bool
+	pref  []byte
+}
+
+// resumedIterator continues the scan of a cursor by the iterators of
+// the segments which hold the keys left in order.
+type resumedIterator struct {
+	i   int // level of the segments being generated
+	c   int // next byte of the level
+	k   []byte
+	v   []byte // value of an exact segment
+	l   []byte // last key of the cursor resumed
+	seg *segment
+	cur *cursor
+	tx  *transaction
+	itr Iterator
 }
 
 type Iterator interface {
@@ -27,6 +104,81 @@ type Iterator interface {
 	Valid() bool
 	Key() []byte
 	Value() ([]byte, error)
+	Cursor() []byte
+}
+
+const (
+	R = iota // read
+	W        // write
+	L        // lock
+)
+
+// undo restores an entry of the read set, the write set or the locked keys
+type undo struct {
+	typ int
+	ok  bool // the entry existed
+	k   string
+	v   []byte
+	e   *extent // the value was spilled
+	dl  int64   // expiry time of the value
+	mg  bool    // the value is a merge operand
+	ts  uint64
+}
+
+// extent is a value in the spill file
+type extent struct {
+	o int64
+	n int
+}
+
+// spill holds the values of a large write set
+type spill struct {
+	n  int64 // size of the file
+	fp *os.File
+	mp map[string]*extent
+}
+
+// erasure is a range of keys deleted by a transaction, a nil end is unbounded
+type erasure struct {
+	start []byte
+	end   []byte
+}
+
+type savepoint struct {
+	id  int
+	s   int64 // transaction size
+	n   int   // length of undo log
+	rgs int   // number of scanned ranges
+}
+
+// readahead coalesces the reads of values close to each other in the data file
+type readahead struct {
+	n   int // bytes read by a single read at most
+	avg int // estimated size of a value, a read covers it beyond its last offset
+}
+
+// prefetcher reads a snapshot iterator ahead in the background, the next batch
+// of keys and their values is read while the current one is consumed.
+type prefetcher struct {
+	i    int
+	es   []*ahead
+	ch   chan *batch
+	done chan struct{}
+	fin  chan struct{}
+	itr  mvcc.Iterator
+}
+
+type batch struct {
+	es  []*ahead
+	err error
+}
+
+type ahead struct {
+	ok bool // v is read
+	k  []byte
+	v  []byte
+	o  uint64
+	ts uint64
 }
 
 type kvList struct {
@@ -36,29 +188,63 @@ type kvList struct {
 }
 
 type forwardIterator struct {
-	kv  *kvList
-	tx  *transaction
-	itr mvcc.Iterator
+	opt  IteratorOptions
+	pref []byte
+	last []byte // the last key passed
+	ra   *readahead
+	r    *scheduler.Range // scanned range
+	kv   *kvList
+	tx   *transaction
+	itr  mvcc.Iterator     // nil if the snapshot is exhausted
+	wi   skiplist.Iterator // pending writes
 }
 
 type backwardIterator struct {
-	kv  *kvList
-	tx  *transaction
-	itr mvcc.Iterator
+	opt  IteratorOptions
+	pref []byte
+	last []byte // the last key passed
+	ra   *readahead
+	r    *scheduler.Range // scanned range
+	kv   *kvList
+	tx   *transaction
+	itr  mvcc.Iterator     // nil if the snapshot is exhausted
+	wi   skiplist.Iterator // pending writes
 }
 
+// transaction is the view of a transaction on a namespace, its keys are tagged
+// by the namespace. The views of a transaction share its state.
 type transaction struct {
-	s    int  // transaction size
-	ro   bool // read only
+	ns mvcc.Namespace
+	*state
+}
+
+type state struct {
+	s    int64 // transaction size
+	ro   bool  // read only
+	pes  bool  // pessimistic, writes lock their keys
+	lk   bool  // holds key locks
+	lvl  Isolation
 	n    int32
+	id   uint64 // id in scheduler, also the owner of key locks
 	rts  uint64 // read timestamp
 	wts  uint64 // write timestamp
 	d    data.Data
-	m    mvcc.MVCC
+	m    mvcc.Space
 	w    wal.Writer
 	log  logger.Log
-	rmp  map[string]uint64 // read cache
-	wmp  map[string][]byte // write cache
+	rmp  map[string]uint64   // read cache
+	rgs  []*scheduler.Range  // scanned ranges
+	lmp  map[string]struct{} // locked keys
+	spn  int                 // last savepoint id
+	ul   []*undo             // undo log
+	sps  []*savepoint
+	lt   locker.KeyTable
+	wmp  skiplist.SkipList // write cache ordered by key
+	sp   *spill            // nil until the write cache is spilled
+	dmp  map[string]int64  // expiry time of written values
+	mmp  map[string]bool   // written values which are merge operands
+	er   *erasure          // range deletion
+	ops  merge.Operators
 	schd scheduler.Scheduler
 }
 
@@ -78,7 +264,7 @@ func (w *walWriter) NewPage(pg cache.Page) {
 }
 
 func (w *walWriter) NewSyncPage(pg cache.Page) {
-	if pg, ok := w.mp[pg.PageNumber]; ok {
+	if pg, ok := w.mp[pg.PageNumber()]; ok {
 		pg.s = true
 	}
 }
@@ -0,0 +1,285 @@
+package tuple
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/infinivision/gaeadb/errmsg"
+)
+
+// Pack encodes t into a key, the key is the prefix of the keys of the tuples
+// which extend t and can be passed to the iterators as it is.
+func (t Tuple) Pack() ([]byte, error) {
+	return t.pack(nil, false)
+}
+
+// Range returns the keys from start up to end of the tuples which extend t,
+// t itself is not in the range. It can be passed to DeleteRange.
+func (t Tuple) Range() ([]byte, []byte, error) {
+	k, err := t.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(append([]byte{}, k...), 0x00), append(k, 0xFF), nil
+}
+
+// PrefixEnd returns the first key after the keys with prefix pref,
+// it is nil if no key follows them.
+func PrefixEnd(pref []byte) []byte {
+	end := append([]byte{}, pref...)
+	for len(end) > 0 && end[len(end)-1] == 0xFF {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil
+	}
+	end[len(end)-1]++
+	return end
+}
+
+// Unpack decodes a key packed by Pack, integers are decoded as int64
+// unless they only fit in uint64.
+func Unpack(k []byte) (Tuple, error) {
+	t, _, err := unpack(k, false)
+	return t, err
+}
+
+func (t Tuple) pack(buf []byte, nested bool) ([]byte, error) {
+	var err error
+
+	for _, e := range t {
+		switch x := e.(type) {
+		case nil:
+			if buf = append(buf, nilCode); nested {
+				buf = append(buf, escape)
+			}
+		case []byte:
+			buf = appendBytes(append(buf, bytesCode), x)
+		case string:
+			buf = appendBytes(append(buf, stringCode), []byte(x))
+		case Tuple:
+			if buf, err = x.pack(append(buf, nestedCode), true); err != nil {
+				return nil, err
+			}
+			buf = append(buf, 0x00)
+		case []interface{}:
+			if buf, err = Tuple(x).pack(append(buf, nestedCode), true); err != nil {
+				return nil, err
+			}
+			buf = append(buf, 0x00)
+		case int:
+			buf = appendInt(buf, int64(x))
+		case int8:
+			buf = appendInt(buf, int64(x))
+		case int16:
+			buf = appendInt(buf, int64(x))
+		case int32:
+			buf = appendInt(buf, int64(x))
+		case int64:
+			buf = appendInt(buf, x)
+		case uint:
+			buf = appendUint(buf, uint64(x))
+		case uint8:
+			buf = appendUint(buf, uint64(x))
+		case uint16:
+			buf = appendUint(buf, uint64(x))
+		case uint32:
+			buf = appendUint(buf, uint64(x))
+		case uint64:
+			buf = appendUint(buf, x)
+		case float32:
+			buf = append(buf, floatCode, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(buf[len(buf)-4:], order32(math.Float32bits(x)))
+		case float64:
+			buf = append(buf, doubleCode, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint64(buf[len(buf)-8:], order64(math.Float64bits(x)))
+		case bool:
+			if x {
+				buf = append(buf, trueCode)
+			} else {
+				buf = append(buf, falseCode)
+			}
+		default:
+			return nil, errmsg.UnsupportedType
+		}
+	}
+	return buf, nil
+}
+
+// unpack decodes the elements of buf up to the end of a nested tuple if nested
+// and returns the bytes left.
+func unpack(buf []byte, nested bool) (Tuple, []byte, error) {
+	var err error
+
+	t := Tuple{}
+	for len(buf) > 0 {
+		c := buf[0]
+		switch buf = buf[1:]; {
+		case c == nilCode && !nested:
+			t = append(t, nil)
+		case c == nilCode:
+			if len(buf) == 0 || buf[0] != escape { // end of the nested tuple
+				return t, buf, nil
+			}
+			t, buf = append(t, nil), buf[1:]
+		case c == bytesCode || c == stringCode:
+			var x []byte
+			if x, buf, err = readBytes(buf); err != nil {
+				return nil, nil, err
+			}
+			if c == bytesCode {
+				t = append(t, x)
+			} else {
+				t = append(t, string(x))
+			}
+		case c == nestedCode:
+			var x Tuple
+			if x, buf, err = unpack(buf, true); err != nil {
+				return nil, nil, err
+			}
+			t = append(t, x)
+		case c >= intZero-8 && c <= intZero+8:
+			var x interface{}
+			if x, buf, err = readInt(c, buf); err != nil {
+				return nil, nil, err
+			}
+			t = append(t, x)
+		case c == floatCode:
+			if len(buf) < 4 {
+				return nil, nil, errmsg.InvalidTuple
+			}
+			t, buf = append(t, math.Float32frombits(reorder32(binary.BigEndian.Uint32(buf)))), buf[4:]
+		case c == doubleCode:
+			if len(buf) < 8 {
+				return nil, nil, errmsg.InvalidTuple
+			}
+			t, buf = append(t, math.Float64frombits(reorder64(binary.BigEndian.Uint64(buf)))), buf[8:]
+		case c == falseCode || c == trueCode:
+			t = append(t, c == trueCode)
+		default:
+			return nil, nil, errmsg.InvalidTuple
+		}
+	}
+	if nested { // not ended
+		return nil, nil, errmsg.InvalidTuple
+	}
+	return t, nil, nil
+}
+
+// appendBytes appends x ended by a zero byte, the zero bytes of x are escaped.
+func appendBytes(buf, x []byte) []byte {
+	for _, b := range x {
+		if buf = append(buf, b); b == 0x00 {
+			buf = append(buf, escape)
+		}
+	}
+	return append(buf, 0x00)
+}
+
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	x := []byte{}
+	for i := 0; i < len(buf); i++ {
+		if buf[i] != 0x00 {
+			x = append(x, buf[i])
+			continue
+		}
+		if i+1 == len(buf) || buf[i+1] != escape {
+			return x, buf[i+1:], nil
+		}
+		x, i = append(x, 0x00), i+1
+	}
+	return nil, nil, errmsg.InvalidTuple
+}
+
+// appendInt appends n by the fewest bytes, a negative n by the ones' complement of its magnitude.
+func appendInt(buf []byte, n int64) []byte {
+	if n >= 0 {
+		return appendUint(buf, uint64(n))
+	}
+	m := uint64(^n) + 1
+	l := size(m)
+	buf = append(buf, byte(intZero-l))
+	return appendBigEndian(buf, ^m, l)
+}
+
+func appendUint(buf []byte, n uint64) []byte {
+	l := size(n)
+	buf = append(buf, byte(intZero+l))
+	return appendBigEndian(buf, n, l)
+}
+
+// readInt decodes an integer of code c, it is an int64 unless it only fits in uint64.
+func readInt(c byte, buf []byte) (interface{}, []byte, error) {
+	var n uint64
+
+	l := int(c) - intZero
+	if l < 0 {
+		l = -l
+	}
+	if len(buf) < l {
+		return nil, nil, errmsg.InvalidTuple
+	}
+	for _, b := range buf[:l] {
+		n = n<<8 | uint64(b)
+	}
+	switch {
+	case c >= intZero && n > math.MaxInt64:
+		return n, buf[l:], nil
+	case c >= intZero:
+		return int64(n), buf[l:], nil
+	}
+	m := ^n
+	if l < 8 {
+		m &= 1<<(uint(l)*8) - 1
+	}
+	if m > 1<<63 {
+		return nil, nil, errmsg.InvalidTuple
+	}
+	return -int64(m), buf[l:], nil
+}
+
+// size returns the number of bytes of n without its leading zero bytes
+func size(n uint64) int {
+	l := 0
+	for ; n > 0; n >>= 8 {
+		l++
+	}
+	return l
+}
+
+func appendBigEndian(buf []byte, n uint64, l int) []byte {
+	for i := l - 1; i >= 0; i-- {
+		buf = append(buf, byte(n>>(uint(i)*8)))
+	}
+	return buf
+}
+
+// order32 maps the bits of a float to bits in the order of the floats,
+// a negative float is inverted and a positive one has its sign set.
+func order32(b uint32) uint32 {
+	if b&(1<<31) != 0 {
+		return ^b
+	}
+	return b | 1<<31
+}
+
+func reorder32(b uint32) uint32 {
+	if b&(1<<31) != 0 {
+		return b &^ (1 << 31)
+	}
+	return ^b
+}
+
+func order64(b uint64) uint64 {
+	if b&(1<<63) != 0 {
+		return ^b
+	}
+	return b | 1<<63
+}
+
+func reorder64(b uint64) uint64 {
+	if b&(1<<63) != 0 {
+		return b &^ (1 << 63)
+	}
+	return ^b
+}
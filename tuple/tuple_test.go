@@ -0,0 +1,378 @@
+package tuple
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/infinivision/gaeadb/errmsg"
+)
+
+func TestOrder(t *testing.T) {
+	nan32, nan64 := float32(math.NaN()), math.NaN()
+	ts := []Tuple{
+		{},
+		{nil},
+		{nil, nil},
+		{[]byte{}},
+		{[]byte{0x00}},
+		{[]byte{0x00, 0x00}},
+		{[]byte{0x00, 0x01}},
+		{[]byte{0x00, 0xFF}},
+		{[]byte{0x01}},
+		{[]byte{0xFF}},
+		{""},
+		{"\x00"},
+		{"\x00\x00"},
+		{"\x00\xFF"},
+		{"a"},
+		{"a", nil},
+		{"a", "b"},
+		{"a\x00"},
+		{"a\x00b"},
+		{"a\x01"},
+		{"b"},
+		{Tuple{}},
+		{Tuple{nil}},
+		{Tuple{nil, nil}},
+		{Tuple{nil, 1}},
+		{Tuple{"a\x00"}},
+		{Tuple{Tuple{}}},
+		{Tuple{1}},
+		{Tuple{1}, nil},
+		{Tuple{1, 2}},
+		{int64(math.MinInt64)},
+		{int64(math.MinInt64 + 1)},
+		{-65536},
+		{-65535},
+		{-256},
+		{-255},
+		{-2},
+		{-1},
+		{0},
+		{0, "a"},
+		{1},
+		{1, nil},
+		{1, "a"},
+		{1, "b"},
+		{255},
+		{256},
+		{65535},
+		{65536},
+		{int64(math.MaxInt64)},
+		{uint64(math.MaxInt64 + 1)},
+		{uint64(math.MaxUint64)},
+		{float32(math.Inf(-1))},
+		{float32(-1)},
+		{float32(-math.SmallestNonzeroFloat32)},
+		{float32(math.Copysign(0, -1))},
+		{float32(0)},
+		{float32(math.SmallestNonzeroFloat32)},
+		{float32(1)},
+		{float32(math.Inf(1))},
+		{nan32},
+		{math.Inf(-1)},
+		{-math.MaxFloat64},
+		{-1.5},
+		{math.Copysign(0, -1)},
+		{0.0},
+		{1.5},
+		{math.MaxFloat64},
+		{math.Inf(1)},
+		{nan64},
+		{false},
+		{false, false},
+		{true},
+	}
+	for i := 1; i < len(ts); i++ {
+		a, err := ts[i-1].Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ts[i].Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(a, b) >= 0 {
+			t.Fatalf("%v packs to %x, not before %v packed to %x", ts[i-1], a, ts[i], b)
+		}
+		if c := compare(ts[i-1], ts[i]); c >= 0 {
+			t.Fatalf("%v does not compare before %v: %v", ts[i-1], ts[i], c)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, x := range []struct {
+		t, u Tuple
+	}{
+		{Tuple{}, Tuple{}},
+		{Tuple{nil}, Tuple{nil}},
+		{Tuple{[]byte{}, []byte{0x00, 0xFF, 0x00}}, Tuple{[]byte{}, []byte{0x00, 0xFF, 0x00}}},
+		{Tuple{"", "a\x00b", "\x00"}, Tuple{"", "a\x00b", "\x00"}},
+		{Tuple{int8(-1), int16(-300), int32(70000), 0}, Tuple{int64(-1), int64(-300), int64(70000), int64(0)}},
+		{Tuple{uint8(255), uint(1), uint64(math.MaxUint64)}, Tuple{int64(255), int64(1), uint64(math.MaxUint64)}},
+		{Tuple{int64(math.MinInt64), int64(math.MaxInt64)}, Tuple{int64(math.MinInt64), int64(math.MaxInt64)}},
+		{Tuple{float32(-1.5), float32(math.Copysign(0, -1)), math.Inf(-1), 2.25}, Tuple{float32(-1.5), float32(math.Copysign(0, -1)), math.Inf(-1), 2.25}},
+		{Tuple{true, false}, Tuple{true, false}},
+		{Tuple{Tuple{nil, Tuple{}}, []interface{}{"a", nil}}, Tuple{Tuple{nil, Tuple{}}, Tuple{"a", nil}}},
+	} {
+		k, err := x.t.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := Unpack(k)
+		if err != nil {
+			t.Fatalf("unpack %v: %v", x.t, err)
+		}
+		if !reflect.DeepEqual(u, x.u) {
+			t.Fatalf("%v unpacks to %#v, expected %#v", x.t, u, x.u)
+		}
+		if y, err := u.Pack(); err != nil || !bytes.Equal(y, k) { // keeps the sign of zero
+			t.Fatalf("%v packs to %x, its unpacked tuple to %x (%v)", x.t, k, y, err)
+		}
+	}
+	k, err := Tuple{math.NaN()}.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := Unpack(k); err != nil || len(u) != 1 || !math.IsNaN(u[0].(float64)) {
+		t.Fatalf("NaN unpacks to %v (%v)", u, err)
+	}
+}
+
+func TestProperty(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		a, b := random(r, 0), random(r, 0)
+		if r.Intn(4) == 0 { // share a prefix
+			b = append(append(Tuple{}, a[:r.Intn(len(a)+1)]...), b...)
+		}
+		x, err := a.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		y, err := b.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := compare(a, b); sign(bytes.Compare(x, y)) != c {
+			t.Fatalf("%#v and %#v compare %v, packed %x and %x", a, b, c, x, y)
+		}
+		u, err := Unpack(x)
+		if err != nil {
+			t.Fatalf("unpack %#v: %v", a, err)
+		}
+		if compare(a, u) != 0 {
+			t.Fatalf("%#v unpacks to %#v", a, u)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := (Tuple{struct{}{}}).Pack(); err != errmsg.UnsupportedType {
+		t.Fatalf("unsupported type packs: %v", err)
+	}
+	for _, k := range [][]byte{
+		{bytesCode, 'a'},
+		{nestedCode, intZero},
+		{intZero + 2, 0x01},
+		{floatCode, 0x00},
+		{doubleCode, 0x00, 0x00},
+		{0x30},
+	} {
+		if _, err := Unpack(k); err != errmsg.InvalidTuple {
+			t.Fatalf("%x unpacks: %v", k, err)
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for _, x := range []struct{ pref, end []byte }{
+		{nil, nil},
+		{[]byte{0xFF, 0xFF}, nil},
+		{[]byte{0x01}, []byte{0x02}},
+		{[]byte{0x01, 0xFF}, []byte{0x02}},
+	} {
+		if end := PrefixEnd(x.pref); !bytes.Equal(end, x.end) {
+			t.Fatalf("prefix end of %x is %x, expected %x", x.pref, end, x.end)
+		}
+	}
+	start, end, err := Tuple{"a"}.Range()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := Tuple{"a", nil}.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(k, start) < 0 || bytes.Compare(k, end) >= 0 {
+		t.Fatalf("%x is not in the range %x - %x", k, start, end)
+	}
+}
+
+// random returns a tuple of up to four elements, nested up to two levels
+func random(r *rand.Rand, depth int) Tuple {
+	t := Tuple{}
+	for n := r.Intn(5); n > 0; n-- {
+		switch r.Intn(10) {
+		case 0:
+			t = append(t, nil)
+		case 1:
+			t = append(t, randomBytes(r))
+		case 2:
+			t = append(t, string(randomBytes(r)))
+		case 3:
+			if depth < 2 {
+				t = append(t, random(r, depth+1))
+			} else {
+				t = append(t, nil)
+			}
+		case 4:
+			t = append(t, int64(r.Uint64()>>uint(r.Intn(64))))
+		case 5:
+			t = append(t, -int64(r.Uint64()>>uint(r.Intn(64)+1)))
+		case 6:
+			t = append(t, []interface{}{int64(math.MinInt64), int64(-1), int64(0), uint64(math.MaxUint64), r.Uint64()}[r.Intn(5)])
+		case 7:
+			fs := []float64{math.Inf(-1), -1, math.Copysign(0, -1), 0, 1, math.Inf(1), math.NaN(), r.NormFloat64()}
+			t = append(t, float32(fs[r.Intn(len(fs))]))
+		case 8:
+			fs := []float64{math.Inf(-1), -math.MaxFloat64, math.Copysign(0, -1), 0, math.MaxFloat64, math.Inf(1), math.NaN(), r.NormFloat64()}
+			t = append(t, fs[r.Intn(len(fs))])
+		default:
+			t = append(t, r.Intn(2) == 0)
+		}
+	}
+	return t
+}
+
+func randomBytes(r *rand.Rand) []byte {
+	bs := []byte{0x00, 0x01, 'a', 0xFF}
+	x := []byte{}
+	for n := r.Intn(4); n > 0; n-- {
+		x = append(x, bs[r.Intn(len(bs))])
+	}
+	return x
+}
+
+// compare compares the tuples a and b by the order of the elements documented by Tuple
+func compare(a, b Tuple) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareElement(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(a) - len(b))
+}
+
+func compareElement(a, b interface{}) int {
+	if c := sign(rank(a) - rank(b)); c != 0 {
+		return c
+	}
+	switch x := a.(type) {
+	case []byte:
+		return bytes.Compare(x, b.([]byte))
+	case string:
+		return bytes.Compare([]byte(x), []byte(b.(string)))
+	case Tuple:
+		return compare(x, b.(Tuple))
+	case float32:
+		return compareFloat(float64(x), float64(b.(float32)))
+	case float64:
+		return compareFloat(x, b.(float64))
+	case int, int64, uint64:
+		return compareInt(a, b)
+	}
+	return 0
+}
+
+// rank returns the position of the type of e in the order of the types
+func rank(e interface{}) int {
+	switch x := e.(type) {
+	case nil:
+		return 0
+	case []byte:
+		return 1
+	case string:
+		return 2
+	case Tuple:
+		return 3
+	case int, int64, uint64:
+		return 4
+	case float32:
+		return 5
+	case float64:
+		return 6
+	case bool:
+		if x {
+			return 8
+		}
+		return 7
+	}
+	panic("unexpected type")
+}
+
+func compareInt(a, b interface{}) int {
+	x, xneg := magnitude(a)
+	y, yneg := magnitude(b)
+	switch {
+	case xneg && !yneg:
+		return -1
+	case !xneg && yneg:
+		return 1
+	case x == y:
+		return 0
+	case (x < y) != xneg:
+		return -1
+	}
+	return 1
+}
+
+func magnitude(e interface{}) (uint64, bool) {
+	switch x := e.(type) {
+	case int:
+		return magnitude(int64(x))
+	case int64:
+		if x < 0 {
+			return uint64(^x) + 1, true
+		}
+		return uint64(x), false
+	case uint64:
+		return x, false
+	}
+	panic("unexpected type")
+}
+
+// compareFloat orders -0 before +0 and a positive NaN after +Inf
+func compareFloat(x, y float64) int {
+	switch {
+	case math.IsNaN(x) && math.IsNaN(y):
+		return 0
+	case math.IsNaN(x):
+		return 1
+	case math.IsNaN(y):
+		return -1
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	case math.Signbit(x) && !math.Signbit(y):
+		return -1
+	case !math.Signbit(x) && math.Signbit(y):
+		return 1
+	}
+	return 0
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,20 @@
+package tuple
+
+// Tuple is a list of elements packed into a key, the keys of tuples compare by bytes.Compare
+// as the tuples do. Elements of different types compare by type in the order nil, []byte,
+// string, Tuple, integers, float32, float64, false, true. Integers of any size compare by value.
+type Tuple []interface{}
+
+const (
+	nilCode    = 0x00
+	bytesCode  = 0x01
+	stringCode = 0x02
+	nestedCode = 0x05
+	intZero    = 0x14 // an integer of n bytes is coded by intZero+n, or intZero-n if negative
+	floatCode  = 0x20
+	doubleCode = 0x21
+	falseCode  = 0x26
+	trueCode   = 0x27
+)
+
+const escape = 0xFF // follows a zero byte which does not end an element
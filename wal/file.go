@@ -20,123 +20,31 @@ func (f *file) flush() error {
 
 func (f *file) alloc(size int32) (int32, error) {
 	curr := f.size
-	if curr+size > constant.MaxTransactionSize {
+	if curr+size > constant.MaxSegmentSize {
 		return 0, errmsg.OutOfSpace
 	}
 	f.size += size
 	return curr, nil
 }
 
+// getSize finds the end of the valid records, every record
+// is skipped by the length in its header.
 func (f *file) getSize() {
-	buf := append([]byte{}, f.buf...)
 	o := 0
-	for len(buf) > HeaderSize {
-		n := int(binary.LittleEndian.Uint32(buf[o+SumSize:]))
-		if len(buf[o+HeaderSize:]) < n {
+	for len(f.buf[o:]) > HeaderSize {
+		n := int(binary.LittleEndian.Uint32(f.buf[o+SumSize:]))
+		switch {
+		case len(f.buf[o+HeaderSize:]) < n || n == 0:
 			f.size = int32(o)
 			return
-		}
-		if sum.Sum(crc32.New(crc32.MakeTable(crc32.Castagnoli)), buf[o+HeaderSize:o+HeaderSize+n]) != binary.LittleEndian.Uint32(buf[o:]) {
+		case sum.Sum(crc32.New(crc32.MakeTable(crc32.Castagnoli)), f.buf[o+HeaderSize:o+HeaderSize+n]) != binary.LittleEndian.Uint32(f.buf[o:]):
 			f.size = int32(o)
 			return
-		}
-		switch buf[o+HeaderSize] {
-		case EM:
+		case f.buf[o+HeaderSize] == EM:
 			f.size = int32(o)
 			return
-		case EC:
-			o += 1
-		case SC:
-			if len(buf[o+1:]) < 4 {
-				f.size = int32(o)
-				return
-			}
-			n := int(binary.LittleEndian.Uint32(buf[o+1:]))
-			if len(buf[o+5:]) < n*8 { // incomplete record
-				f.size = int32(o)
-				return
-			}
-			o += 5 + n*8
-		case AT:
-			if len(buf[o+1:]) < 8 {
-				f.size = int32(o)
-				return
-			}
-			o += 9
-		case CT:
-			if len(buf[o+1:]) < 8 {
-				f.size = int32(o)
-				return
-			}
-			o += 9
-		case ST:
-			if len(buf[o+1:]) < 8 {
-				f.size = int32(o)
-				return
-			}
-			n := int(binary.LittleEndian.Uint32(buf[o+9:]))
-			j := 13
-			for i := 0; i < n; i++ {
-				if len(buf[o+j:]) < 2 {
-					f.size = int32(o)
-					return
-				}
-				kn := int(binary.LittleEndian.Uint16(buf[o+j:]))
-				j += 2
-				if len(buf[o+j:]) < kn {
-					f.size = int32(o)
-					return
-				}
-				j += kn
-				if len(buf[o+j:]) < 2 {
-					f.size = int32(o)
-					return
-				}
-				vn := int(binary.LittleEndian.Uint16(buf[o:]))
-				j += 2
-				if len(buf[o+j:]) < vn {
-					f.size = int32(o)
-					return
-				}
-				j += vn
-			}
-			o += j
-		case WD:
-			if len(buf[o+1:]) < 8 {
-				f.size = int32(o)
-				return
-			}
-			if len(buf[o+9:]) < 8 {
-				f.size = int32(o)
-				return
-			}
-			n := int(binary.LittleEndian.Uint32(buf[9:]))
-			if len(buf[o+13:]) < n*8 {
-				f.size = int32(o)
-				return
-			}
-			o += 13 + n*8
-		case NP:
-			if len(buf[o+1:]) < 30 {
-				f.size = int32(o)
-				return
-			}
-			o += 31
-		case CP:
-			if len(buf[o+1:]) < 20 {
-				f.size = int32(o)
-				return
-			}
-			on := int(binary.LittleEndian.Uint16(buf[o+17:]))
-			vn := int(binary.LittleEndian.Uint16(buf[o+19:]))
-			o += 21 + on*2 + vn*8
-		case NS:
-			if len(buf[o+1:]) < 26 {
-				f.size = int32(o)
-				return
-			}
-			o += 27
 		}
+		o += HeaderSize + n
 	}
 	f.size = int32(o)
 }
@@ -147,10 +55,10 @@ func newFile(path string, flag int) (*file, error) {
 		return nil, err
 	}
 	defer unix.Close(fd)
-	if err := unix.Ftruncate(fd, constant.MaxTransactionSize); err != nil {
+	if err := unix.Ftruncate(fd, constant.MaxSegmentSize); err != nil {
 		return nil, err
 	}
-	buf, err := unix.Mmap(fd, 0, constant.MaxTransactionSize, unix.PROT_WRITE|unix.PROT_READ, unix.MAP_SHARED)
+	buf, err := unix.Mmap(fd, 0, constant.MaxSegmentSize, unix.PROT_WRITE|unix.PROT_READ, unix.MAP_SHARED)
 	if err != nil {
 		return nil, err
 	}
@@ -163,7 +71,7 @@ func openFile(path string, flag int) (*file, error) {
 		return nil, err
 	}
 	defer unix.Close(fd)
-	buf, err := unix.Mmap(fd, 0, constant.MaxTransactionSize, unix.PROT_WRITE|unix.PROT_READ, unix.MAP_SHARED)
+	buf, err := unix.Mmap(fd, 0, constant.MaxSegmentSize, unix.PROT_WRITE|unix.PROT_READ, unix.MAP_SHARED)
 	if err != nil {
 		return nil, err
 	}
@@ -13,7 +13,9 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func Recover(dir string, d data.Data, m mvcc.MVCC, c cache.Cache) (uint64, error) {
+// Recover redoes the committed transactions of the log in the namespaces of m,
+// and flushes the caches cs of their indexes.
+func Recover(dir string, d data.Data, m mvcc.Space, cs []cache.Cache) (uint64, error) {
 	h, l, err := headAndLast(dir)
 	if err != nil {
 		return 0, err
@@ -27,122 +29,142 @@ func Recover(dir string, d data.Data, m mvcc.MVCC, c cache.Cache) (uint64, error
 	}
 	switch {
 	case !ok:
-		return recoverFromStart(dir, h, l, d, m, c)
+		return recoverFromStart(dir, h, l, d, m, cs)
 	default:
-		return recoverFromCKPT(dir, h, last, d, m, c)
+		return recoverFromCKPT(dir, h, last, d, m, cs)
 	}
-	return 0, nil
 }
 
-func recoverFromCKPT(dir string, head, last int, d data.Data, m mvcc.MVCC, c cache.Cache) (uint64, error) {
+func recoverFromCKPT(dir string, head, last int, d data.Data, m mvcc.Space, cs []cache.Cache) (uint64, error) {
 	rs, err := loads(head, last, dir)
 	if err != nil {
 		return 0, err
 	}
 	ts, mp, mr, mq, rs := getTimestamp(rs, true)
+	if rs, err = qualify(rs, m); err != nil {
+		return 0, err
+	}
+	rs = chain(rs)
 	for i, j := 0, len(rs); i < j; i++ {
 		switch r := rs[i].rc.(type) {
+		case deleteRange:
+			if _, ok := mp[r.ts]; ok {
+				if err := m.DelRange(r.start, r.end, r.ts); err != nil {
+					return 0, err
+				}
+			}
 		case startTransaction:
 			if _, ok := mr[r.ts]; ok {
 				break
 			}
-			if _, ok := mp[r.ts]; ok { // redo
-				os := mq[r.ts].os
-				for k, v := range r.mp {
-					switch {
-					case v == nil:
-						if !m.Exist([]byte(k), r.ts) {
-							if err := m.Del([]byte(k), r.ts, &recoverWriter{}); err != nil {
-								return 0, err
-							}
-						}
-					default:
-						if err := d.Write(os[0], v); err != nil {
-							return 0, err
-						}
-						if !m.Exist([]byte(k), r.ts) {
-							if err := m.Set([]byte(k), os[0], r.ts, &recoverWriter{}); err != nil {
-								return 0, err
-							}
-						}
-						os = os[1:]
-					}
-				}
-			} else { // undo
-				if wd, ok := mq[r.ts]; ok {
-					for _, o := range wd.os {
-						if err := d.Del(o); err != nil {
-							return 0, err
-						}
-					}
-				}
-				for k, _ := range r.mp {
-					if m.Exist([]byte(k), r.ts) {
-						if err := m.Set([]byte(k), constant.Cancel, r.ts, &recoverWriter{}); err != nil {
-							return 0, err
-						}
-					}
+			if _, ok := mp[r.ts]; ok {
+				if err := redo(r, mq[r.ts].os, d, m); err != nil {
+					return 0, err
 				}
+			} else if err := undo(r, mq[r.ts], d, m); err != nil {
+				return 0, err
 			}
 		}
 	}
-	c.Flush()
+	for _, c := range cs {
+		c.Flush()
+	}
 	return ts, nil
 }
 
-func recoverFromStart(dir string, head, last int, d data.Data, m mvcc.MVCC, c cache.Cache) (uint64, error) {
+func recoverFromStart(dir string, head, last int, d data.Data, m mvcc.Space, cs []cache.Cache) (uint64, error) {
 	rs, err := loads(head, last, dir)
 	if err != nil {
 		return 0, err
 	}
 	ts, mp, _, mq, rs := getTimestamp(rs, false)
+	if rs, err = qualify(rs, m); err != nil {
+		return 0, err
+	}
+	rs = chain(rs)
 	for i, j := 0, len(rs); i < j; i++ {
 		switch r := rs[i].rc.(type) {
-		case startTransaction:
-			if _, ok := mp[r.ts]; ok { // redo
-				os := mq[r.ts].os
-				for k, v := range r.mp {
-					switch {
-					case v == nil:
-						if !m.Exist([]byte(k), r.ts) {
-							if err := m.Del([]byte(k), r.ts, &recoverWriter{}); err != nil {
-								return 0, err
-							}
-						}
-					default:
-						if err := d.Write(os[0], v); err != nil {
-							return 0, err
-						}
-						if !m.Exist([]byte(k), r.ts) {
-							if err := m.Set([]byte(k), os[0], r.ts, &recoverWriter{}); err != nil {
-								return 0, err
-							}
-						}
-						os = os[1:]
-					}
-				}
-			} else { // undo
-				if wd, ok := mq[r.ts]; ok {
-					for _, o := range wd.os {
-						if err := d.Del(o); err != nil {
-							return 0, err
-						}
-					}
+		case deleteRange:
+			if _, ok := mp[r.ts]; ok {
+				if err := m.DelRange(r.start, r.end, r.ts); err != nil {
+					return 0, err
 				}
-				for k, _ := range r.mp {
-					if m.Exist([]byte(k), r.ts) {
-						if err := m.Set([]byte(k), constant.Cancel, r.ts, &recoverWriter{}); err != nil {
-							return 0, err
-						}
-					}
+			}
+		case startTransaction:
+			if _, ok := mp[r.ts]; ok {
+				if err := redo(r, mq[r.ts].os, d, m); err != nil {
+					return 0, err
 				}
+			} else if err := undo(r, mq[r.ts], d, m); err != nil {
+				return 0, err
 			}
 		}
 	}
-	c.Flush()
+	for _, c := range cs {
+		c.Flush()
+	}
 	return ts, nil
 }
 
+// redo writes the values of the committed transaction r kept at the offsets os of the
+// data file and its versions missing from the index.
+func redo(r startTransaction, os []uint64, d data.Data, m mvcc.Space) error {
+	for _, k := range r.ks {
+		var o uint64
+
+		dl, ok := r.dmp[k]
+		switch v := r.mp[k]; {
+		case ok:
+			if err := d.Write(os[0], data.Expire(v, dl)); err != nil {
+				return err
+			}
+			o, os = os[0]|data.ExpireMark, os[1:]
+		case r.mmp[k]:
+			if err := d.Write(os[0], v); err != nil {
+				return err
+			}
+			o, os = os[0]|data.MergeMark, os[1:]
+		case v == nil:
+			o = constant.Delete
+		case len(v) == 0:
+			o = constant.Empty
+		case len(v) <= data.MaxInlineSize:
+			o, _ = data.Inline(v)
+		default:
+			if err := d.Write(os[0], v); err != nil {
+				return err
+			}
+			o, os = os[0], os[1:]
+		}
+		if !m.Exist([]byte(k), r.ts) {
+			if err := m.Set([]byte(k), o, r.ts, &recoverWriter{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// undo releases the space of the values of the uncommitted transaction r
+// and cancels its versions in the index.
+func undo(r startTransaction, wd *writeData, d data.Data, m mvcc.Space) error {
+	if wd != nil {
+		for _, o := range wd.os {
+			if err := d.Del(o); err != nil {
+				return err
+			}
+		}
+	}
+	for k, _ := range r.mp {
+		if m.Exist([]byte(k), r.ts) {
+			if err := m.Set([]byte(k), constant.Cancel, r.ts, &recoverWriter{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func headAndLast(dir string) (int, int, error) {
 	h := -1
 	for i := 0; ; i++ {
@@ -243,15 +265,24 @@ func load(path string) ([]*record, error) {
 			}
 			rs = append(rs, &record{endTransaction{binary.LittleEndian.Uint64(buf[1:])}})
 			buf = buf[9:]
-		case ST:
+		case ST, NT:
 			if len(buf[1:]) < 8 { // incomplete record
 				return rs, nil
 			}
 			st := startTransaction{}
 			st.mp = make(map[string][]byte)
+			st.dmp = make(map[string]int64)
+			st.mmp = make(map[string]bool)
 			st.ts = binary.LittleEndian.Uint64(buf[1:])
 			n := int(binary.LittleEndian.Uint32(buf[9:]))
 			o := 13
+			if buf[0] == NT {
+				if len(buf[o:]) < 1 || len(buf[o+1:]) < int(buf[o]) {
+					return rs, nil
+				}
+				st.ns = string(buf[o+1 : o+1+int(buf[o])])
+				o += 1 + int(buf[o])
+			}
 			for i := 0; i < n; i++ {
 				if len(buf[o:]) < 2 {
 					return rs, nil
@@ -262,19 +293,49 @@ func load(path string) ([]*record, error) {
 					return rs, nil
 				}
 				k := buf[o : o+kn]
+				st.ks = append(st.ks, string(k))
 				o += kn
 				if len(buf[o:]) < 2 {
 					return rs, nil
 				}
 				vn := int(binary.LittleEndian.Uint16(buf[o:]))
 				o += 2
+				if vn == data.Expiring {
+					if len(buf[o:]) < 10 {
+						return rs, nil
+					}
+					st.dmp[string(k)] = int64(binary.LittleEndian.Uint64(buf[o:]))
+					vn = int(binary.LittleEndian.Uint16(buf[o+8:]))
+					o += 10
+				}
+				if vn == data.Merging {
+					if len(buf[o:]) < 2 {
+						return rs, nil
+					}
+					st.mmp[string(k)] = true
+					vn = int(binary.LittleEndian.Uint16(buf[o:]))
+					o += 2
+				}
+				if vn == data.Extended {
+					if len(buf[o:]) < 4 {
+						return rs, nil
+					}
+					vn = int(binary.LittleEndian.Uint32(buf[o:]))
+					o += 4
+				}
+				empty := vn == data.Empty
+				if empty {
+					vn = 0
+				}
 				if len(buf[o:]) < vn {
 					return rs, nil
 				}
-				if vn > 0 {
-					v := buf[o : o+vn]
-					st.mp[string(k)] = v
-				} else {
+				switch {
+				case empty:
+					st.mp[string(k)] = []byte{}
+				case vn > 0:
+					st.mp[string(k)] = buf[o : o+vn]
+				default: // deleted
 					st.mp[string(k)] = nil
 				}
 				o += vn
@@ -349,6 +410,35 @@ func load(path string) ([]*record, error) {
 			}
 			rs = append(rs, &record{cp})
 			buf = buf[o:]
+		case DR, NR:
+			if len(buf[1:]) < 10 { // incomplete record
+				return rs, nil
+			}
+			dr := deleteRange{}
+			dr.ts = binary.LittleEndian.Uint64(buf[1:])
+			o := 9
+			if buf[0] == NR {
+				if len(buf[o+1:]) < int(buf[o])+2 {
+					return rs, nil
+				}
+				dr.ns = string(buf[o+1 : o+1+int(buf[o])])
+				o += 1 + int(buf[o])
+			}
+			n := int(binary.LittleEndian.Uint16(buf[o:]))
+			o += 2
+			if len(buf[o:]) < n+2 {
+				return rs, nil
+			}
+			dr.start = buf[o : o+n]
+			o += n
+			n = int(binary.LittleEndian.Uint16(buf[o:]))
+			o += 2
+			if len(buf[o:]) < n {
+				return rs, nil
+			}
+			dr.end = buf[o : o+n]
+			rs = append(rs, &record{dr})
+			buf = buf[o+n:]
 		case NS:
 			if len(buf[1:]) < 26 { // incomplete record
 				return rs, nil
@@ -418,7 +508,11 @@ func getTimestamp(rs []*record, isCKPT bool) (uint64, map[uint64]struct{}, map[u
 	for i := len(rs) - 1; i >= 0; i-- {
 		switch r := rs[i].rc.(type) {
 		case writeData:
-			mq[r.ts] = &r
+			if wd, ok := mq[r.ts]; ok { // chained records
+				wd.os = append(r.os, wd.os...)
+			} else {
+				mq[r.ts] = &r
+			}
 		case startCKPT:
 			if isCKPT {
 				mr := make(map[uint64]struct{})
@@ -436,3 +530,78 @@ func getTimestamp(rs []*record, isCKPT bool) (uint64, map[uint64]struct{}, map[u
 	}
 	return ts, mp, nil, mq, rs
 }
+
+// qualify tags the keys of the records by the namespaces they are logged in.
+func qualify(rs []*record, m mvcc.Space) ([]*record, error) {
+	for _, r := range rs {
+		switch x := r.rc.(type) {
+		case startTransaction:
+			ns, err := m.Namespace(x.ns)
+			if err != nil {
+				return nil, err
+			}
+			st := startTransaction{ts: x.ts, ns: x.ns}
+			st.mp = make(map[string][]byte)
+			st.dmp = make(map[string]int64)
+			st.mmp = make(map[string]bool)
+			for _, k := range x.ks {
+				q := string(append([]byte{ns.Tag}, k...))
+				st.ks = append(st.ks, q)
+				st.mp[q] = x.mp[k]
+				if dl, ok := x.dmp[k]; ok {
+					st.dmp[q] = dl
+				}
+				if x.mmp[k] {
+					st.mmp[q] = true
+				}
+			}
+			r.rc = st
+		case deleteRange:
+			ns, err := m.Namespace(x.ns)
+			if err != nil {
+				return nil, err
+			}
+			x.start = append([]byte{ns.Tag}, x.start...)
+			if len(x.end) > 0 {
+				x.end = append([]byte{ns.Tag}, x.end...)
+			}
+			r.rc = x
+		}
+	}
+	return rs, nil
+}
+
+// chain merges the start records of a transaction logged by chained records,
+// the transaction is redone as a whole only if its commit record is found.
+func chain(rs []*record) []*record {
+	var xs []*record
+
+	mp := make(map[uint64]*startTransaction)
+	for _, r := range rs {
+		if st, ok := r.rc.(startTransaction); ok {
+			if x, ok := mp[st.ts]; ok {
+				for _, k := range st.ks {
+					x.ks = append(x.ks, k)
+					x.mp[k] = st.mp[k]
+					if dl, ok := st.dmp[k]; ok {
+						x.dmp[k] = dl
+					}
+					if st.mmp[k] {
+						x.mmp[k] = true
+					}
+				}
+				continue
+			}
+			mp[st.ts] = &st
+			xs = append(xs, &record{&st})
+			continue
+		}
+		xs = append(xs, r)
+	}
+	for _, r := range xs {
+		if st, ok := r.rc.(*startTransaction); ok {
+			r.rc = *st
+		}
+	}
+	return xs
+}
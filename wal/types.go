@@ -13,6 +13,9 @@ const (
 	NP             // new prefix
 	CP             // change prefix
 	NS             // new suffix
+	DR             // delete range
+	NT             // start transaction in a namespace
+	NR             // delete range in a namespace
 )
 
 const (
@@ -40,8 +43,19 @@ type endTransaction struct {
 }
 
 type startTransaction struct {
-	ts uint64
-	mp map[string][]byte
+	ts  uint64
+	ns  string   // namespace, empty for the default one
+	ks  []string // keys in the order of the log, which is the order of data offsets
+	mp  map[string][]byte
+	dmp map[string]int64 // expiry time of values
+	mmp map[string]bool  // values which are merge operands
+}
+
+type deleteRange struct {
+	ts    uint64
+	ns    string
+	start []byte
+	end   []byte
 }
 
 type writeData struct {
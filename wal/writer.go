@@ -7,8 +7,9 @@ import (
 	"sync/atomic"
 	"syscall"
 
+	"github.com/infinivision/gaeadb/constant"
+	"github.com/infinivision/gaeadb/errmsg"
 	"github.com/infinivision/gaeadb/sum"
-	"golang.org/x/sys/unix"
 )
 
 func (w *walWriter) Close() error {
@@ -52,6 +53,9 @@ func (w *walWriter) Append(record []byte) error {
 
 func (w *walWriter) alloc(record []byte) (*file, int32, error) {
 	m := int32(len(record) + HeaderSize)
+	if m > constant.MaxSegmentSize {
+		return nil, -1, errmsg.OutOfSpace
+	}
 	w.Lock()
 	defer w.Unlock()
 	for {